@@ -1,32 +1,71 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
+	"strconv"
 	"syscall"
+	"time"
 
-	"github.com/dimiro1/health"
-	"github.com/dimiro1/health/db"
 	"github.com/gorilla/mux"
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/auth"
+	"github.com/lanceplarsen/go-vault-demo/bulk"
+	"github.com/lanceplarsen/go-vault-demo/certs"
 	"github.com/lanceplarsen/go-vault-demo/client"
 	"github.com/lanceplarsen/go-vault-demo/config"
 	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/encryption"
+	"github.com/lanceplarsen/go-vault-demo/logging"
+	"github.com/lanceplarsen/go-vault-demo/metrics"
 	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/openapi"
+	"github.com/lanceplarsen/go-vault-demo/probe"
+	"github.com/lanceplarsen/go-vault-demo/rpc"
 	"github.com/lanceplarsen/go-vault-demo/service"
-	_ "github.com/lib/pq"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
 )
 
 var orderService = service.Order{}
+var customerService = service.Customer{}
+var eventService = service.Events{}
+var webhookService = service.Webhooks{}
+var grpcService = rpc.Server{}
+
+// Callers see clear text when authentication is disabled
+var masking *auth.Masking
+
+func viewFor(r *http.Request) service.View {
+	if masking == nil {
+		return service.Clear
+	}
+	return service.View(masking.View(r))
+}
 
 func AllOrdersEndpoint(w http.ResponseWriter, r *http.Request) {
-	orders, err := orderService.GetOrders()
+	var orders []models.Order
+	var err error
+
+	//Search on the blind index if we were given a customer
+	if customer := r.URL.Query().Get("customer"); len(customer) > 0 {
+		orders, err = orderService.GetOrdersByCustomer(r.Context(), customer, viewFor(r))
+	} else {
+		orders, err = orderService.GetOrders(r.Context(), viewFor(r))
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 	if len(orders) > 0 {
@@ -40,27 +79,531 @@ func CreateOrderEndpoint(w http.ResponseWriter, r *http.Request) {
 	var order models.Order
 
 	defer r.Body.Close()
-	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+	if !decodeBody(w, r, &order) {
 		return
 	}
-	//Respond with the updated order
-	order, err := orderService.CreateOrder(order)
+	//Retries with the same key get the first response back
+	var err error
+	if key := r.Header.Get("Idempotency-Key"); len(key) > 0 {
+		var replayed bool
+		order, replayed, err = orderService.CreateOrderOnce(r.Context(), key, order)
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
+	} else {
+		order, err = orderService.CreateOrder(r.Context(), order)
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithServiceError(w, err)
 		return
 	}
 	respondWithJson(w, http.StatusCreated, order)
 }
 
+func ImportOrdersEndpoint(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	format, ok := bulk.Format(r.Header.Get("Content-Type"))
+	if !ok {
+		respondWithError(w, http.StatusUnsupportedMediaType, "Imports must be application/x-ndjson or text/csv")
+		return
+	}
+	rows, err := bulk.NewReader(format, r.Body)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	count, err := orderService.ImportOrders(r.Context(), rows)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, map[string]interface{}{"result": "success", "imported": count})
+}
+
+// Stream every order a page at a time. Once the first page is out the
+// status is sent, so a later failure aborts the response instead.
+func ExportOrdersEndpoint(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = bulk.NDJSON
+	}
+	rows, err := bulk.NewWriter(format, w)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	started := false
+	_, err = orderService.ExportOrders(r.Context(), viewFor(r), func(orders []models.Order) error {
+		if !started {
+			w.Header().Set("Content-Type", bulk.ContentType(format))
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=orders.%s", format))
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		for _, order := range orders {
+			if err := rows.Write(order); err != nil {
+				return err
+			}
+		}
+		if err := rows.Flush(); err != nil {
+			return err
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && !started {
+		respondWithServiceError(w, err)
+		return
+	}
+	if err != nil {
+		log.WithError(err).WithField("request_id", audit.RequestIDFromContext(r.Context())).Error("Order export failed")
+		panic(http.ErrAbortHandler)
+	}
+
+	//An empty table still gets a header and content type
+	if !started {
+		w.Header().Set("Content-Type", bulk.ContentType(format))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=orders.%s", format))
+		w.WriteHeader(http.StatusOK)
+	}
+	rows.Flush()
+}
+
+// Stream order changes as server-sent events until the caller goes away.
+// Last-Event-ID resumes after the last event the caller saw.
+func OrderEventsEndpoint(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+	after := int64(-1)
+	if last := r.Header.Get("Last-Event-ID"); len(last) > 0 {
+		id, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || id < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+		after = id
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	err := eventService.Subscribe(r.Context(), after, viewFor(r), func(events []models.OrderEvent) error {
+		if len(events) == 0 {
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return err
+			}
+		}
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, data); err != nil {
+				return err
+			}
+		}
+		flusher.Flush()
+		return nil
+	})
+	//The status is already out, so the client reconnects with its last id
+	if err != nil {
+		log.WithError(err).WithField("request_id", audit.RequestIDFromContext(r.Context())).Error("Order event stream failed")
+	}
+}
+
+func RestoreOrderEndpoint(w http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order id")
+		return
+	}
+	order, err := orderService.RestoreOrder(r.Context(), id, viewFor(r))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, order)
+}
+
 func DeleteOrdersEndpoint(w http.ResponseWriter, r *http.Request) {
-	if err := orderService.DeleteOrders(); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if err := orderService.DeleteOrders(r.Context()); err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func EraseCustomerEndpoint(w http.ResponseWriter, r *http.Request) {
+	var order models.Order
+
+	defer r.Body.Close()
+	if !decodeBody(w, r, &order) {
+		return
+	}
+	if len(order.CustomerName) == 0 {
+		respondWithServiceError(w, &service.ValidationError{Fields: []service.FieldError{{Field: "CustomerName", Reason: "is required"}}})
+		return
+	}
+	count, err := orderService.EraseCustomer(r.Context(), order.CustomerName)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, map[string]interface{}{"result": "success", "erased": count})
+}
+
+func TransitionOrderEndpoint(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Status string
+	}
+
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order id")
+		return
+	}
+	defer r.Body.Close()
+	if !decodeBody(w, r, &request) {
+		return
+	}
+	transition, err := orderService.TransitionOrder(r.Context(), id, request.Status)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, transition)
+}
+
+func OrderHistoryEndpoint(w http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid order id")
+		return
+	}
+	transitions, err := orderService.OrderHistory(r.Context(), id)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, transitions)
+}
+
+func AllCustomersEndpoint(w http.ResponseWriter, r *http.Request) {
+	customers, err := customerService.GetCustomers(r.Context(), viewFor(r))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	if len(customers) > 0 {
+		respondWithJson(w, http.StatusOK, customers)
+	} else {
+		respondWithJson(w, http.StatusOK, map[string]string{"result": "No customers"})
+	}
+}
+
+func GetCustomerEndpoint(w http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid customer id")
+		return
+	}
+	customer, err := customerService.GetCustomer(r.Context(), id, viewFor(r))
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, customer)
+}
+
+func CreateCustomerEndpoint(w http.ResponseWriter, r *http.Request) {
+	var customer models.Customer
+
+	defer r.Body.Close()
+	if !decodeBody(w, r, &customer) {
+		return
+	}
+	customer, err := customerService.CreateCustomer(r.Context(), customer)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, customer)
+}
+
+func UpdateCustomerEndpoint(w http.ResponseWriter, r *http.Request) {
+	var customer models.Customer
+
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid customer id")
+		return
+	}
+	defer r.Body.Close()
+	if !decodeBody(w, r, &customer) {
+		return
+	}
+	customer.Id = id
+	customer, err = customerService.UpdateCustomer(r.Context(), customer)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, customer)
+}
+
+func DeleteCustomerEndpoint(w http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid customer id")
+		return
+	}
+	if err := customerService.DeleteCustomer(r.Context(), id); err != nil {
+		respondWithServiceError(w, err)
 		return
 	}
 	respondWithJson(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
+func EraseCustomerByIdEndpoint(w http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid customer id")
+		return
+	}
+	count, err := customerService.EraseCustomer(r.Context(), id)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, map[string]interface{}{"result": "success", "erased": count})
+}
+
+func AllWebhooksEndpoint(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := webhookService.GetWebhooks(r.Context())
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, webhooks)
+}
+
+func CreateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	//Webhooks are active unless the caller says otherwise
+	webhook := models.Webhook{Active: true}
+
+	defer r.Body.Close()
+	if !decodeBody(w, r, &webhook) {
+		return
+	}
+	webhook, err := webhookService.CreateWebhook(r.Context(), webhook)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusCreated, webhook)
+}
+
+func UpdateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	webhook := models.Webhook{Active: true}
+
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook id")
+		return
+	}
+	defer r.Body.Close()
+	if !decodeBody(w, r, &webhook) {
+		return
+	}
+	webhook.Id = id
+	webhook, err = webhookService.UpdateWebhook(r.Context(), webhook)
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, webhook)
+}
+
+func DeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid webhook id")
+		return
+	}
+	if err := webhookService.DeleteWebhook(r.Context(), id); err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func DeadLettersEndpoint(w http.ResponseWriter, r *http.Request) {
+	letters, err := webhookService.GetDeadLetters(r.Context())
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, letters)
+}
+
+func RetryDeadLetterEndpoint(w http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid dead letter id")
+		return
+	}
+	if err := webhookService.RetryDeadLetter(r.Context(), id); err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusAccepted, map[string]string{"result": "queued"})
+}
+
+// Liveness only says the process is serving. Dependencies belong in readiness
+// so an outage doesn't get us restarted.
+func LivenessEndpoint(w http.ResponseWriter, r *http.Request) {
+	respondWithJson(w, http.StatusOK, map[string]string{"status": "UP"})
+}
+
+func IntegrityReportEndpoint(w http.ResponseWriter, r *http.Request) {
+	failures, err := orderService.VerifyOrders(r.Context())
+	if err != nil {
+		respondWithServiceError(w, err)
+		return
+	}
+	respondWithJson(w, http.StatusOK, failures)
+}
+
+// Exit status for the audit verify subcommand
+func verifyAudit(auditLog *audit.Log) int {
+	problems, count, err := auditLog.Verify(context.Background())
+	if err != nil {
+		log.WithError(err).Error("Unable to verify audit log")
+		return 2
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		fmt.Printf("Audit log failed verification. Entries: %d Problems: %d\n", count, len(problems))
+		return 1
+	}
+	fmt.Printf("Audit log verified. Entries: %d\n", count)
+	return 0
+}
+
+// Map service and DAO errors to the status the caller should see
+func respondWithServiceError(w http.ResponseWriter, err error) {
+	var invalid *service.ValidationError
+	var rejected *service.ImportError
+	var malformed *bulk.FormatError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &invalid):
+		respondWithJson(w, http.StatusBadRequest, map[string]interface{}{"error": "Invalid request payload", "fields": invalid.Fields})
+	case errors.As(err, &malformed):
+		respondWithError(w, http.StatusBadRequest, malformed.Error())
+	case errors.As(err, &rejected):
+		respondWithJson(w, http.StatusUnprocessableEntity, map[string]interface{}{"error": err.Error(), "invalid": rejected.Invalid, "rows": rejected.Rows})
+	case errors.As(err, &tooLarge):
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit))
+	case err == dao.ErrNotFound, err == dao.ErrCustomerNotFound, err == dao.ErrWebhookNotFound, err == dao.ErrDeadLetterNotFound:
+		respondWithError(w, http.StatusNotFound, err.Error())
+	case err == dao.ErrConflict, err == service.ErrTampered, err == service.ErrKeyReused, err == service.ErrKeyInFlight,
+		err == service.ErrInvalidTransition, err == service.ErrOrderClosed, err == dao.ErrCustomerInUse:
+		respondWithError(w, http.StatusConflict, err.Error())
+	case err == dao.ErrInvalid:
+		respondWithError(w, http.StatusUnprocessableEntity, err.Error())
+	case err == dao.ErrUnavailable:
+		respondWithError(w, http.StatusServiceUnavailable, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Decode a JSON body. Bodies that aren't JSON of the right shape get the
+// same 400 with a reason per field as invalid ones.
+func decodeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		respondWithServiceError(w, decodeError(err))
+		return false
+	}
+	return true
+}
+
+func decodeError(err error) error {
+	var tooLarge *http.MaxBytesError
+	var syntax *json.SyntaxError
+	var mistyped *json.UnmarshalTypeError
+
+	field := service.FieldError{Field: "body"}
+	switch {
+	case errors.As(err, &tooLarge):
+		return err
+	case errors.As(err, &mistyped):
+		if len(mistyped.Field) > 0 {
+			field.Field = mistyped.Field
+		}
+		field.Reason = fmt.Sprintf("must be %s, not %s", jsonType(mistyped.Type), mistyped.Value)
+	case errors.As(err, &syntax):
+		field.Reason = fmt.Sprintf("is not valid JSON at offset %d: %s", syntax.Offset, syntax)
+	case err == io.EOF:
+		field.Reason = "is empty"
+	default:
+		field.Reason = err.Error()
+	}
+	return &service.ValidationError{Fields: []service.FieldError{field}}
+}
+
+// How a Go type is written in JSON
+func jsonType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct, reflect.Ptr, reflect.Interface:
+		return "an object"
+	}
+	return "a number"
+}
+
+// The numeric id in the route
+func pathId(r *http.Request) (int64, error) {
+	return strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+}
+
+// Cap request bodies so a caller can't make us buffer an unbounded payload.
+// Named routes can have their own limit.
+func limitBody(max int64, routes map[string]int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			max := max
+			if route := mux.CurrentRoute(r); route != nil {
+				if limit, ok := routes[route.GetName()]; ok {
+					max = limit
+				}
+			}
+			if r.ContentLength > max {
+				respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body is larger than %d bytes", max))
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func respondWithError(w http.ResponseWriter, code int, msg string) {
 	respondWithJson(w, code, map[string]string{"error": msg})
 }
@@ -73,12 +616,27 @@ func respondWithJson(w http.ResponseWriter, code int, payload interface{}) {
 }
 
 func main() {
-	log.Println("Starting server initialization")
-
 	//Get our config from the file
 	var configurator = config.Config{}
 	configurator.Read()
 
+	//Logging
+	if err := logging.Init(logging.Config{Level: configurator.Log.Level, Format: configurator.Log.Format}); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("Starting server initialization")
+
+	//Tracing
+	shutdownTracing, err := tracing.Init(tracing.Config{
+		Exporter: configurator.Tracing.Exporter,
+		Endpoint: configurator.Tracing.Endpoint,
+		Insecure: configurator.Tracing.Insecure,
+		Ratio:    configurator.Tracing.Ratio,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	//Server params
 	var credential = client.Credential{
 		Token:          configurator.Vault.Credential.Token,
@@ -98,21 +656,21 @@ func main() {
 	}
 
 	//Init it
-	log.Println("Starting vault initialization")
-	err := vault.Initialize()
+	log.Info("Starting vault initialization")
+	err = vault.Initialize()
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	//Make sure we got a DB role
-	log.Println("Starting DB initialization")
+	log.Info("Starting DB initialization")
 	if len(configurator.Vault.Database.Role) == 0 {
 		log.Fatal("Could not get DB role from config.")
 	}
 
 	//See if we need to go get dyanmic DB creds
 	if len(configurator.Database.Username) == 0 && len(configurator.Database.Password) == 0 {
-		log.Printf("DB role: %s", configurator.Vault.Database.Role)
+		log.WithField("role", configurator.Vault.Database.Role).Info("Using DB role")
 		secret, err := vault.GetSecret(fmt.Sprintf("%s/creds/%s", configurator.Vault.Database.Mount, configurator.Vault.Database.Role))
 		if err != nil {
 			log.Fatal(err)
@@ -142,24 +700,337 @@ func main() {
 	//Create service
 	orderService.Vault = &vault
 	orderService.Dao = &orderDao
+	orderService.Tombstones = &dao.Tombstone{}
+	orderService.Customers = &dao.Customer{}
+	orderService.Encyrption.Vault = &vault
 	orderService.Encyrption.Key = configurator.Vault.Transit.Key
+	orderService.Encyrption.LegacyKey = configurator.Vault.Transit.LegacyKey
 	orderService.Encyrption.Mount = configurator.Vault.Transit.Mount
 
+	orderService.Catalog = configurator.Catalog.Products
+	orderService.Keys = &dao.Idempotency{}
+	orderService.KeyTTL = configurator.Idempotency.TTL
+	orderService.Retention = configurator.Retention.Deleted
+	orderService.PurgeMode = configurator.Retention.Mode
+	switch orderService.PurgeMode {
+	case service.PurgeDelete, service.PurgeShred:
+	default:
+		log.Fatalf("Retention mode %s is not supported", orderService.PurgeMode)
+	}
+
+	orderService.Signing.Key = configurator.Vault.Transit.SigningKey
+	orderService.Signing.Mount = configurator.Vault.Transit.Mount
+	orderService.Signing.Mode = configurator.Vault.Transit.Integrity
+
+	customerService.Orders = &orderService
+	customerService.Dao = orderService.Customers
+
+	eventService.Orders = &orderService
+	eventService.Dao = &dao.Event{}
+	eventService.Poll = configurator.Events.KeepAlive
+	eventService.Retention = configurator.Events.Retention
+
+	webhookService.Vault = &vault
+	webhookService.Dao = &dao.Webhook{}
+	webhookService.Events = &eventService
+	webhookService.Mount = configurator.Vault.Transit.Mount
+	webhookService.Key = configurator.Webhooks.Key
+	webhookService.Poll = configurator.Webhooks.Poll
+	webhookService.Timeout = configurator.Webhooks.Timeout
+	webhookService.MaxAttempts = configurator.Webhooks.MaxAttempts
+	webhookService.Backoff = configurator.Webhooks.Backoff
+	webhookService.MaxBackoff = configurator.Webhooks.MaxBackoff
+
+	//Envelope mode only hits Vault when the data key cache misses
+	switch configurator.Vault.Transit.Mode {
+	case "transit":
+	case "envelope":
+		log.WithFields(log.Fields{
+			"datakey_ttl":  configurator.Vault.Transit.DataKeyTTL,
+			"datakey_uses": configurator.Vault.Transit.DataKeyUses,
+		}).Info("Using envelope encryption")
+		orderService.Encyrption.Envelope = &encryption.Envelope{
+			TTL:  configurator.Vault.Transit.DataKeyTTL,
+			Uses: configurator.Vault.Transit.DataKeyUses,
+		}
+	default:
+		log.Fatalf("Transit mode %s is not supported", configurator.Vault.Transit.Mode)
+	}
+
+	//Audit sink
+	var auditStore audit.Store
+	switch configurator.Audit.Sink {
+	case "postgres":
+		auditStore = &dao.Audit{}
+	case "file":
+		auditStore = &audit.File{Path: configurator.Audit.Path}
+	case "none":
+		log.Info("PII access auditing is disabled")
+	default:
+		log.Fatalf("Audit sink %s is not supported", configurator.Audit.Sink)
+	}
+	if auditStore != nil {
+		orderService.Audit = &audit.Log{
+			Vault: &vault,
+			Mount: configurator.Vault.Transit.Mount,
+			Key:   configurator.Audit.Key,
+			Store: auditStore,
+		}
+	}
+
+	//Run the audit verify subcommand instead of the server
+	if len(os.Args) > 2 && os.Args[1] == "audit" && os.Args[2] == "verify" {
+		if orderService.Audit == nil {
+			log.Fatal("Could not get audit sink from config.")
+		}
+		os.Exit(verifyAudit(orderService.Audit))
+	}
+
+	//Bring orders from older releases up to the current stored form
+	go func() {
+		count, err := orderService.Backfill(context.Background())
+		if err != nil {
+			log.WithError(err).Error("Order backfill failed")
+			return
+		}
+		log.WithField("backfilled", count).Info("Order backfill complete")
+	}()
+
+	//Listener certificate, either a static pair or issued by Vault PKI
+	certStore := &certs.Store{}
+	if configurator.Server.TLS.Enabled {
+		if len(configurator.Server.TLS.CertFile) > 0 {
+			if err := certStore.LoadFiles(configurator.Server.TLS.CertFile, configurator.Server.TLS.KeyFile); err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			if len(configurator.Server.TLS.PKI.Role) == 0 {
+				log.Fatal("Could not get PKI role from config.")
+			}
+			pki := &certs.PKI{
+				Vault:      &vault,
+				Mount:      configurator.Server.TLS.PKI.Mount,
+				Role:       configurator.Server.TLS.PKI.Role,
+				CommonName: configurator.Server.TLS.PKI.CommonName,
+				AltNames:   configurator.Server.TLS.PKI.AltNames,
+				TTL:        configurator.Server.TLS.PKI.TTL,
+				Store:      certStore,
+			}
+			notBefore, notAfter, err := pki.Issue()
+			if err != nil {
+				log.Fatal(err)
+			}
+			go pki.Renew(notBefore, notAfter)
+		}
+	}
+
+	//Forget idempotency keys once their TTL is up
+	go func() {
+		for range time.Tick(time.Hour) {
+			count, err := orderService.PurgeKeys(context.Background())
+			if err != nil {
+				log.WithError(err).Error("Idempotency key purge failed")
+				continue
+			}
+			log.WithField("purged", count).Debug("Idempotency key purge complete")
+		}
+	}()
+
+	//Wake event streams on changes and forget events past their retention
+	go eventService.Listen(context.Background())
+	go func() {
+		for range time.Tick(time.Hour) {
+			count, err := eventService.PurgeEvents(context.Background())
+			if err != nil {
+				log.WithError(err).Error("Order event purge failed")
+				continue
+			}
+			log.WithField("purged", count).Debug("Order event purge complete")
+		}
+	}()
+
+	//Purge deleted orders once they are past retention
+	if configurator.Retention.Deleted > 0 {
+		go func() {
+			for range time.Tick(configurator.Retention.Interval) {
+				count, err := orderService.PurgeOrders(context.Background())
+				if err != nil {
+					log.WithError(err).Error("Deleted order purge failed")
+					continue
+				}
+				log.WithFields(log.Fields{
+					"purged": count,
+					"mode":   configurator.Retention.Mode,
+				}).Debug("Deleted order purge complete")
+			}
+		}()
+	} else {
+		log.Info("Deleted orders are kept indefinitely")
+	}
+
+	//Send what the orders trigger queues for webhooks
+	go webhookService.Deliver(context.Background())
+
+	//Authenticators in the order we try them
+	var authenticators []auth.Authenticator
+	for _, method := range configurator.Auth.Methods {
+		switch method {
+		case "vault":
+			authenticators = append(authenticators, &auth.VaultToken{Vault: &vault, CacheTTL: configurator.Auth.Vault.CacheTTL})
+		case "jwt":
+			if len(configurator.Auth.JWT.JWKS) == 0 {
+				log.Fatal("Could not get JWKS from config.")
+			}
+			authenticators = append(authenticators, &auth.JWT{
+				JWKS:       configurator.Auth.JWT.JWKS,
+				Issuer:     configurator.Auth.JWT.Issuer,
+				Audience:   configurator.Auth.JWT.Audience,
+				RolesClaim: configurator.Auth.JWT.RolesClaim,
+				Refresh:    configurator.Auth.JWT.Refresh,
+			})
+		case "mtls":
+			if !configurator.Server.TLS.Enabled || configurator.Server.TLS.ClientAuth == "none" {
+				log.Fatal("Client certificate auth needs TLS with client-auth enabled.")
+			}
+			authenticators = append(authenticators, &auth.ClientCert{})
+		default:
+			log.Fatalf("Auth method %s is not supported", method)
+		}
+	}
+
 	//Router
 	r := mux.NewRouter()
+	r.Use(otelmux.Middleware(tracing.ServiceName))
+	r.Use(audit.RequestID)
+	r.Use(metrics.Middleware)
+	api := r.PathPrefix("/api").Subrouter()
+	if len(authenticators) > 0 {
+		log.WithField("methods", configurator.Auth.Methods).Info("API authentication enabled")
+		api.Use(auth.Middleware(authenticators...))
+	} else {
+		log.Info("API authentication is disabled")
+	}
+
+	//Check payloads against the spec once the caller is known
+	validator, err := openapi.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	api.Use(limitBody(configurator.Server.MaxBody, map[string]int64{"orders-import": configurator.Bulk.MaxBody}))
+	api.Use(validator.Middleware)
+	r.Path("/openapi.json").HandlerFunc(openapi.Handler).Methods("GET")
+
+	//Each route names the operations that let a caller through
+	policy := auth.Policy{
+		Roles:       configurator.Authz.Roles,
+		MetadataKey: configurator.Authz.MetadataKey,
+	}
+	for _, user := range configurator.Authz.Users {
+		policy.Users = append(policy.Users, auth.User{Method: user.Method, Name: user.Name, Roles: user.Roles})
+	}
+	secure := func(handler http.HandlerFunc, operations ...string) http.Handler {
+		if len(authenticators) == 0 {
+			return handler
+		}
+		return policy.Require(operations...)(handler)
+	}
+
+	//Shape encrypted fields for callers without read-pii
+	if len(authenticators) > 0 {
+		masking = &auth.Masking{
+			Policy:  &policy,
+			Default: configurator.Masking.Default,
+			Routes:  configurator.Masking.Routes,
+			Roles:   configurator.Masking.Roles,
+		}
+		if err := masking.Validate(); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	//API Routes
-	r.HandleFunc("/api/orders", AllOrdersEndpoint).Methods("GET")
-	r.HandleFunc("/api/orders", CreateOrderEndpoint).Methods("POST")
-	r.HandleFunc("/api/orders", DeleteOrdersEndpoint).Methods("DELETE")
-
-	//Health Check Routes
-	h := health.NewHandler()
-	conn := fmt.Sprintf("user=%s password=%s dbname=%s host=%s sslmode=disable", configurator.Database.Username, configurator.Database.Password, configurator.Database.Name, configurator.Database.Host)
-	database, _ := sql.Open("postgres", conn)
-	pg := db.NewPostgreSQLChecker(database)
-	h.AddChecker("Postgres", pg)
-	r.Path("/health").Handler(h).Methods("GET")
+	api.Handle("/orders", secure(AllOrdersEndpoint, auth.ReadMasked, auth.ReadPII)).Methods("GET").Name("orders")
+	api.Handle("/orders", secure(CreateOrderEndpoint, auth.Create)).Methods("POST")
+	api.Handle("/orders", secure(DeleteOrdersEndpoint, auth.Delete)).Methods("DELETE")
+	api.Handle("/orders:import", secure(ImportOrdersEndpoint, auth.Create)).Methods("POST").Name("orders-import")
+	api.Handle("/orders:export", secure(ExportOrdersEndpoint, auth.ReadMasked, auth.ReadPII)).Methods("GET").Name("orders-export")
+	api.Handle("/orders/events", secure(OrderEventsEndpoint, auth.ReadMasked, auth.ReadPII)).Methods("GET").Name("orders-events")
+	api.Handle("/orders/{id:[0-9]+}/restore", secure(RestoreOrderEndpoint, auth.Delete)).Methods("POST").Name("orders-restore")
+	api.Handle("/orders/{id:[0-9]+}/transitions", secure(OrderHistoryEndpoint, auth.ReadMasked, auth.ReadPII)).Methods("GET")
+	api.Handle("/orders/{id:[0-9]+}/transitions", secure(TransitionOrderEndpoint, auth.Update)).Methods("POST")
+	api.Handle("/customers", secure(AllCustomersEndpoint, auth.ReadMasked, auth.ReadPII)).Methods("GET").Name("customers")
+	api.Handle("/customers", secure(CreateCustomerEndpoint, auth.Create)).Methods("POST")
+	api.Handle("/customers/{id:[0-9]+}", secure(GetCustomerEndpoint, auth.ReadMasked, auth.ReadPII)).Methods("GET").Name("customers")
+	api.Handle("/customers/{id:[0-9]+}", secure(UpdateCustomerEndpoint, auth.Update)).Methods("PUT")
+	api.Handle("/customers/{id:[0-9]+}", secure(DeleteCustomerEndpoint, auth.Delete)).Methods("DELETE")
+	api.Handle("/customers/{id:[0-9]+}/erase", secure(EraseCustomerByIdEndpoint, auth.Delete)).Methods("POST")
+	api.Handle("/customers/erase", secure(EraseCustomerEndpoint, auth.Delete)).Methods("POST")
+
+	//Admin Routes
+	api.Handle("/admin/integrity", secure(IntegrityReportEndpoint, auth.Admin)).Methods("GET")
+	api.Handle("/webhooks", secure(AllWebhooksEndpoint, auth.Admin)).Methods("GET")
+	api.Handle("/webhooks", secure(CreateWebhookEndpoint, auth.Admin)).Methods("POST")
+	api.Handle("/webhooks/{id:[0-9]+}", secure(UpdateWebhookEndpoint, auth.Admin)).Methods("PUT")
+	api.Handle("/webhooks/{id:[0-9]+}", secure(DeleteWebhookEndpoint, auth.Admin)).Methods("DELETE")
+	api.Handle("/webhooks/dead-letters", secure(DeadLettersEndpoint, auth.Admin)).Methods("GET")
+	api.Handle("/webhooks/dead-letters/{id:[0-9]+}/retry", secure(RetryDeadLetterEndpoint, auth.Admin)).Methods("POST")
+
+	//Health Check Routes. Probes read the last background check, and only
+	//admins get the details.
+	readiness := &probe.Readiness{Interval: configurator.Health.Interval, Notify: grpcService.SetReady}
+	readiness.AddChecker("Vault", vault.SysChecker())
+	readiness.AddChecker("Token", vault.TokenChecker())
+	readiness.AddChecker("Leases", vault.LeaseChecker())
+	readiness.AddChecker("Transit", orderService.Encyrption.Checker())
+	readiness.AddChecker("Postgres", dao.Checker())
+	go readiness.Run(context.Background())
+	ready := readiness.Handler(func(r *http.Request) bool {
+		if len(authenticators) == 0 {
+			return false
+		}
+		identity, err := auth.Authenticate(r, authenticators...)
+		return err == nil && policy.Allowed(identity, auth.Admin)
+	})
+	r.Path("/livez").HandlerFunc(LivenessEndpoint).Methods("GET")
+	r.Path("/readyz").Handler(ready).Methods("GET")
+	r.Path("/health").Handler(ready).Methods("GET")
+
+	//Metrics Routes
+	metrics.RegisterPool(dao.PoolStats)
+	r.Path("/metrics").Handler(promhttp.Handler()).Methods("GET")
+
+	//Listener TLS config shared by REST and gRPC
+	var tlsConfig *tls.Config
+	if configurator.Server.TLS.Enabled {
+		tlsConfig, err = certs.ServerConfig(certStore, configurator.Server.TLS.ClientAuth, configurator.Server.TLS.ClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	//gRPC server on its own port, with health following the readiness checks
+	grpcService.Orders = &orderService
+	grpcService.Authenticators = authenticators
+	grpcService.Policy = &policy
+	grpcService.Masking = masking
+	grpcService.Reflection = configurator.GRPC.Reflection
+	grpcService.MaxMessage = int(configurator.Server.MaxBody)
+	if configurator.GRPC.Enabled {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%v", configurator.GRPC.Port))
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcServer := grpcService.GRPC(tlsConfig)
+		go func() {
+			log.WithFields(log.Fields{
+				"port": configurator.GRPC.Port,
+				"tls":  tlsConfig != nil,
+			}).Info("gRPC server is now accepting requests")
+			if err := grpcServer.Serve(listener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 	//Catch SIGINT AND SIGTERM to gracefully tear down tokens and secrets
 	var gracefulStop = make(chan os.Signal)
@@ -167,14 +1038,28 @@ func main() {
 	signal.Notify(gracefulStop, syscall.SIGINT)
 	go func() {
 		sig := <-gracefulStop
-		fmt.Printf("caught sig: %+v", sig)
+		log.WithField("signal", sig).Info("Caught signal")
+		grpcService.Shutdown()
 		vault.Close()
+		shutdownTracing(context.Background())
 		os.Exit(0)
 	}()
 
 	//Start server
-	log.Println(fmt.Sprintf("Server is now accepting requests on port %v", configurator.Server.Port))
-	if err := http.ListenAndServe(fmt.Sprintf(":%v", configurator.Server.Port), r); err != nil {
+	server := &http.Server{Addr: fmt.Sprintf(":%v", configurator.Server.Port), Handler: r, TLSConfig: tlsConfig}
+	if tlsConfig == nil {
+		log.WithField("port", configurator.Server.Port).Info("Server is now accepting requests")
+		if err := server.ListenAndServe(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"port":        configurator.Server.Port,
+		"client_auth": configurator.Server.TLS.ClientAuth,
+	}).Info("Server is now accepting TLS requests")
+	if err := server.ListenAndServeTLS("", ""); err != nil {
 		log.Fatal(err)
 	}
 }
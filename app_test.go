@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+func TestDecodeBody(t *testing.T) {
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"valid", `{"CustomerName":"Lance","ProductName":"Vault"}`, http.StatusOK, ""},
+		{"empty", ``, http.StatusBadRequest, `{"error":"Invalid request payload","fields":[{"field":"body","reason":"is empty"}]}`},
+		{"truncated", `{"CustomerName":`, http.StatusBadRequest, `{"error":"Invalid request payload","fields":[{"field":"body","reason":"unexpected EOF"}]}`},
+		{"not json", `CustomerName=Lance`, http.StatusBadRequest,
+			`{"error":"Invalid request payload","fields":[{"field":"body","reason":"is not valid JSON at offset 1: invalid character 'C' looking for beginning of value"}]}`},
+		{"wrong type", `{"CustomerId":"7"}`, http.StatusBadRequest, `{"error":"Invalid request payload","fields":[{"field":"CustomerId","reason":"must be a number, not string"}]}`},
+		{"string as number", `{"ProductName":5}`, http.StatusBadRequest, `{"error":"Invalid request payload","fields":[{"field":"ProductName","reason":"must be a string, not number"}]}`},
+		{"not an object", `["Lance"]`, http.StatusBadRequest, `{"error":"Invalid request payload","fields":[{"field":"body","reason":"must be an object, not array"}]}`},
+		{"too large", `{"CustomerName":"` + strings.Repeat("a", 100) + `"}`, http.StatusRequestEntityTooLarge, `{"error":"Request body is larger than 64 bytes"}`},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/api/orders", strings.NewReader(c.body))
+			r.Body = http.MaxBytesReader(w, r.Body, 64)
+
+			var order models.Order
+			ok := decodeBody(w, r, &order)
+			if ok != (c.status == http.StatusOK) {
+				t.Fatalf("decodeBody() = %v, want %v", ok, !ok)
+			}
+			if ok {
+				return
+			}
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+			if compact(w.Body.String()) != compact(c.want) {
+				t.Errorf("body = %s, want %s", w.Body.String(), c.want)
+			}
+		})
+	}
+}
+
+// Reencode JSON so key order and spacing don't matter
+func compact(s string) string {
+	var v interface{}
+	json.Unmarshal([]byte(s), &v)
+	out, _ := json.Marshal(v)
+	return string(out)
+}
@@ -0,0 +1,281 @@
+// Package audit records who encrypted, decrypted or deleted which orders and customers.
+// Every entry carries a transit HMAC over itself and a hash of the entry
+// before it, so a missing or edited entry breaks the chain.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/auth"
+	"github.com/lanceplarsen/go-vault-demo/client"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Actions we audit. The ids of customer actions are customer ids.
+const (
+	Encrypt         = "encrypt"
+	Decrypt         = "decrypt"
+	Delete          = "delete"
+	Restore         = "restore"
+	Purge           = "purge"
+	Erase           = "erase"
+	CustomerEncrypt = "customer-encrypt"
+	CustomerDecrypt = "customer-decrypt"
+	CustomerDelete  = "customer-delete"
+)
+
+// Stores append a batch of entries all at once or not at all
+type Store interface {
+	Append(ctx context.Context, entries []models.AuditEntry) error
+	Last(ctx context.Context) (*models.AuditEntry, error)
+	Each(ctx context.Context, fn func(models.AuditEntry) error) error
+}
+
+// Most entries signed and appended at a time
+const maxBatch = 100
+
+// Entries link to the hash of the one before them. Entries written before
+// that link to its HMAC.
+const linkPrefix = "sha256:"
+
+// Log appends entries in batches. Callers queue their entry and one writer
+// at a time links, signs and appends everything queued, so concurrent
+// requests share a transit call and an insert instead of taking turns.
+type Log struct {
+	Vault *client.Vault
+	Mount string
+	Key   string
+	Store Store
+
+	mutex    sync.Mutex
+	pending  []pendingEntry
+	flushing bool
+
+	//Only the writer touches the chain head
+	last  *models.AuditEntry
+	ready bool
+}
+
+type pendingEntry struct {
+	entry models.AuditEntry
+	done  chan error
+}
+
+// Record appends an entry for the caller and request in ctx
+func (l *Log) Record(ctx context.Context, action string, ids []int64) error {
+	ctx, span := tracing.Start(ctx, "audit.Record", attribute.String("audit.action", action))
+	defer span.End()
+
+	caller, method := "system", "internal"
+	if identity := auth.FromContext(ctx); identity != nil {
+		caller, method = identity.Name, identity.Method
+	}
+	if ids == nil {
+		ids = []int64{}
+	}
+
+	pending := pendingEntry{
+		entry: models.AuditEntry{
+			Time:      time.Now().UTC().Truncate(time.Microsecond),
+			Action:    action,
+			Caller:    caller,
+			Method:    method,
+			RequestID: RequestIDFromContext(ctx),
+			OrderIDs:  ids,
+		},
+		done: make(chan error, 1),
+	}
+
+	l.mutex.Lock()
+	l.pending = append(l.pending, pending)
+	if !l.flushing {
+		l.flushing = true
+		//The writer outlives any one request
+		go l.flush()
+	}
+	l.mutex.Unlock()
+
+	return tracing.Error(span, <-pending.done)
+}
+
+// Write what is queued until the queue is empty
+func (l *Log) flush() {
+	for {
+		l.mutex.Lock()
+		batch := l.pending
+		if len(batch) > maxBatch {
+			batch = batch[:maxBatch]
+		}
+		l.pending = l.pending[len(batch):]
+		if len(batch) == 0 {
+			l.pending = nil
+			l.flushing = false
+			l.mutex.Unlock()
+			return
+		}
+		l.mutex.Unlock()
+
+		err := l.write(context.Background(), batch)
+		for _, pending := range batch {
+			pending.done <- err
+		}
+	}
+}
+
+func (l *Log) write(ctx context.Context, batch []pendingEntry) error {
+	ctx, span := tracing.Start(ctx, "audit.write", attribute.Int("audit.entries", len(batch)))
+	defer span.End()
+
+	entries := make([]models.AuditEntry, len(batch))
+	inputs := make([]string, len(batch))
+
+	//Another instance may have extended the chain so retry from its head
+	var err error
+	for attempt := 0; attempt < 3; attempt++ {
+		if !l.ready {
+			if l.last, err = l.Store.Last(ctx); err != nil {
+				return err
+			}
+			l.ready = true
+		}
+
+		prev := l.last
+		for i, pending := range batch {
+			entries[i] = pending.entry
+			entries[i].Seq = 1
+			if prev != nil {
+				entries[i].Seq = prev.Seq + 1
+				entries[i].Prev = link(*prev)
+			}
+			inputs[i] = canonicalEntry(entries[i])
+			prev = &entries[i]
+		}
+
+		var hmacs []string
+		var errs []error
+		hmacs, errs, err = l.Vault.HMACBatch(ctx, l.path("hmac"), inputs)
+		if err != nil {
+			return err
+		}
+		for i := range entries {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			entries[i].HMAC = hmacs[i]
+		}
+
+		if err = l.Store.Append(ctx, entries); err == nil {
+			last := entries[len(entries)-1]
+			l.last = &last
+			return nil
+		}
+		l.ready = false
+	}
+
+	return tracing.Error(span, fmt.Errorf("Unable to append audit entries: %s", err))
+}
+
+// Verify walks the chain and reports every gap, broken link or bad HMAC
+func (l *Log) Verify(ctx context.Context) ([]string, int, error) {
+	var problems []string
+	var prev *models.AuditEntry
+	var batch []models.AuditEntry
+	count := 0
+
+	check := func() error {
+		var inputs []string
+		var hmacs []string
+		for _, entry := range batch {
+			inputs = append(inputs, canonicalEntry(entry))
+			hmacs = append(hmacs, entry.HMAC)
+		}
+		valid, err := l.Vault.VerifyHMACBatch(ctx, l.path("verify"), inputs, hmacs)
+		if err != nil {
+			return err
+		}
+		for i, entry := range batch {
+			if !valid[i] {
+				problems = append(problems, fmt.Sprintf("Entry %d has been modified", entry.Seq))
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := l.Store.Each(ctx, func(entry models.AuditEntry) error {
+		count++
+		switch {
+		case prev == nil && entry.Seq != 1:
+			problems = append(problems, fmt.Sprintf("Entries 1 to %d are missing", entry.Seq-1))
+		case prev != nil && entry.Seq != prev.Seq+1:
+			problems = append(problems, fmt.Sprintf("Entries %d to %d are missing", prev.Seq+1, entry.Seq-1))
+		}
+		if prev != nil && !linked(entry, *prev) {
+			problems = append(problems, fmt.Sprintf("Entry %d does not chain to entry %d", entry.Seq, prev.Seq))
+		}
+		if prev == nil && entry.Seq == 1 && len(entry.Prev) > 0 {
+			problems = append(problems, "Entry 1 chains to an entry that doesn't exist")
+		}
+		e := entry
+		prev = &e
+
+		batch = append(batch, entry)
+		if len(batch) == 100 {
+			return check()
+		}
+		return nil
+	})
+	if err != nil {
+		return problems, count, err
+	}
+
+	return problems, count, check()
+}
+
+func (l *Log) path(op string) string {
+	return fmt.Sprintf("%s/%s/%s", l.Mount, op, l.Key)
+}
+
+// The link to an entry is a hash of everything its HMAC covers, so a whole
+// batch can be linked before any of it is signed
+func link(entry models.AuditEntry) string {
+	sum := sha256.Sum256([]byte(canonicalEntry(entry)))
+	return linkPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func linked(entry models.AuditEntry, prev models.AuditEntry) bool {
+	if strings.HasPrefix(entry.Prev, linkPrefix) {
+		return entry.Prev == link(prev)
+	}
+	return entry.Prev == prev.HMAC
+}
+
+// Everything but the HMAC itself, with times at the precision we store
+func canonicalEntry(entry models.AuditEntry) string {
+	ids := entry.OrderIDs
+	if ids == nil {
+		ids = []int64{}
+	}
+
+	fields, _ := json.Marshal([]interface{}{
+		"v1",
+		entry.Seq,
+		entry.Time.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano),
+		entry.Action,
+		entry.Caller,
+		entry.Method,
+		entry.RequestID,
+		ids,
+		entry.Prev,
+	})
+	return base64.StdEncoding.EncodeToString(fields)
+}
@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/client"
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+// memory keeps the chain in a slice
+type memory struct {
+	mutex   sync.Mutex
+	entries []models.AuditEntry
+}
+
+func (m *memory) Append(ctx context.Context, entries []models.AuditEntry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.entries = append(m.entries, entries...)
+	return nil
+}
+
+func (m *memory) Last(ctx context.Context) (*models.AuditEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.entries) == 0 {
+		return nil, nil
+	}
+	last := m.entries[len(m.entries)-1]
+	return &last, nil
+}
+
+func (m *memory) Each(ctx context.Context, fn func(models.AuditEntry) error) error {
+	for _, entry := range m.entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A Vault whose HMAC of an input is vault:v1:<input>. Each call takes a
+// moment so concurrent records queue up behind it.
+func newLog(t *testing.T) (*Log, *memory, *int32) {
+	var hmacCalls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			BatchInput []map[string]string `json:"batch_input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+
+		var results []map[string]interface{}
+		for _, item := range body.BatchInput {
+			if strings.Contains(r.URL.Path, "/hmac/") {
+				results = append(results, map[string]interface{}{"hmac": "vault:v1:" + item["input"]})
+			} else {
+				results = append(results, map[string]interface{}{"valid": item["hmac"] == "vault:v1:"+item["input"]})
+			}
+		}
+		data := map[string]interface{}{"renewable": false, "ttl": 3600}
+		if strings.Contains(r.URL.Path, "/hmac/") {
+			atomic.AddInt32(&hmacCalls, 1)
+			time.Sleep(10 * time.Millisecond)
+		}
+		if strings.HasPrefix(r.URL.Path, "/v1/transit/") {
+			data = map[string]interface{}{"batch_results": results}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	vault := &client.Vault{Scheme: u.Scheme, Host: host, Port: port, Authentication: "token", Credential: client.Credential{Token: "test"}}
+	if err := vault.Initialize(); err != nil {
+		t.Fatalf("Initialize() = %v", err)
+	}
+
+	store := &memory{}
+	return &Log{Vault: vault, Mount: "transit", Key: "audit", Store: store}, store, &hmacCalls
+}
+
+func TestRecordBatchesConcurrentEntries(t *testing.T) {
+	l, store, hmacCalls := newLog(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id int64) {
+			defer wg.Done()
+			if err := l.Record(context.Background(), Decrypt, []int64{id}); err != nil {
+				t.Errorf("Record() = %v", err)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	problems, count, err := l.Verify(context.Background())
+	if err != nil || len(problems) > 0 || count != 50 {
+		t.Fatalf("Verify() = %v, %d, %v, want 50 entries and no problems", problems, count, err)
+	}
+	if n := atomic.LoadInt32(hmacCalls); n >= 50 {
+		t.Errorf("Record() made %d HMAC calls for 50 entries, want them batched", n)
+	}
+	for i, entry := range store.entries {
+		if entry.Seq != int64(i+1) {
+			t.Fatalf("entry %d has seq %d", i, entry.Seq)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(entries []models.AuditEntry) []models.AuditEntry
+		want   []string
+	}{
+		{"intact", func(e []models.AuditEntry) []models.AuditEntry { return e }, nil},
+		{"edited", func(e []models.AuditEntry) []models.AuditEntry {
+			e[2].Caller = "someone-else"
+			return e
+		}, []string{"Entry 4 does not chain to entry 3", "Entry 3 has been modified"}},
+		{"removed", func(e []models.AuditEntry) []models.AuditEntry {
+			return append(e[:2:2], e[3:]...)
+		}, []string{"Entries 3 to 3 are missing", "Entry 4 does not chain to entry 2"}},
+		{"relinked", func(e []models.AuditEntry) []models.AuditEntry {
+			e[3].Prev = link(e[1])
+			return e
+		}, []string{"Entry 4 does not chain to entry 3", "Entry 5 does not chain to entry 4", "Entry 4 has been modified"}},
+		{"first removed", func(e []models.AuditEntry) []models.AuditEntry {
+			return e[1:]
+		}, []string{"Entries 1 to 1 are missing"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l, store, _ := newLog(t)
+			for i := 0; i < 5; i++ {
+				if err := l.Record(context.Background(), Encrypt, []int64{int64(i)}); err != nil {
+					t.Fatalf("Record() = %v", err)
+				}
+			}
+			store.entries = c.change(store.entries)
+
+			problems, _, err := l.Verify(context.Background())
+			if err != nil {
+				t.Fatalf("Verify() = %v", err)
+			}
+			if strings.Join(problems, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("Verify() = %q, want %q", problems, c.want)
+			}
+		})
+	}
+}
+
+// Entries from before hash links chain to the previous HMAC
+func TestVerifyHMACLinkedEntries(t *testing.T) {
+	l, store, _ := newLog(t)
+
+	var prev string
+	for seq := int64(1); seq <= 3; seq++ {
+		entry := models.AuditEntry{Seq: seq, Time: time.Now().UTC().Truncate(time.Microsecond), Action: Encrypt, Caller: "lance", Method: "vault", OrderIDs: []int64{seq}, Prev: prev}
+		entry.HMAC = "vault:v1:" + canonicalEntry(entry)
+		store.entries = append(store.entries, entry)
+		prev = entry.HMAC
+	}
+	if err := l.Record(context.Background(), Decrypt, []int64{1}); err != nil {
+		t.Fatalf("Record() = %v", err)
+	}
+
+	problems, count, err := l.Verify(context.Background())
+	if err != nil || len(problems) > 0 || count != 4 {
+		t.Errorf("Verify() = %v, %d, %v, want 4 entries and no problems", problems, count, err)
+	}
+	if !strings.HasPrefix(store.entries[3].Prev, linkPrefix) {
+		t.Errorf("new entry Prev = %q, want a hash link", store.entries[3].Prev)
+	}
+}
@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+// File keeps the audit chain as JSON lines in a local file
+type File struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+func (f *File) Append(ctx context.Context, entries []models.AuditEntry) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	var lines []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(lines); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (f *File) Last(ctx context.Context) (*models.AuditEntry, error) {
+	var last *models.AuditEntry
+
+	err := f.Each(ctx, func(entry models.AuditEntry) error {
+		last = &entry
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return last, err
+}
+
+func (f *File) Each(ctx context.Context, fn func(models.AuditEntry) error) error {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry models.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
@@ -0,0 +1,84 @@
+// Package auth identifies API callers. Each Authenticator looks for its own
+// credential on the request and the middleware attaches the first identity
+// found to the request context.
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Identity struct {
+	Name     string
+	Method   string
+	EntityID string
+	Roles    []string
+	Policies []string
+	Metadata map[string]string
+}
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Authenticators return ErrNoCredentials when the request doesn't carry
+// their kind of credential so the next one gets a turn.
+var ErrNoCredentials = errors.New("No credentials in request.")
+
+type contextKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the caller identity or nil for unauthenticated requests
+func FromContext(ctx context.Context) *Identity {
+	identity, _ := ctx.Value(contextKey{}).(*Identity)
+	return identity
+}
+
+// Middleware rejects requests no authenticator can identify with a 401
+func Middleware(authenticators ...Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, err := Authenticate(r, authenticators...)
+			if err == ErrNoCredentials {
+				Reject(w, http.StatusUnauthorized, "Authentication required")
+				return
+			}
+			if err != nil {
+				Reject(w, http.StatusUnauthorized, "Invalid credentials")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+		})
+	}
+}
+
+// Authenticate returns the identity from the first authenticator that finds
+// its credential, or ErrNoCredentials when none do.
+func Authenticate(r *http.Request, authenticators ...Authenticator) (*Identity, error) {
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		if err != nil {
+			log.WithField("method", r.Method).WithField("path", r.URL.Path).WithError(err).Warn("Authentication failed")
+			return nil, err
+		}
+		return identity, nil
+	}
+	return nil, ErrNoCredentials
+}
+
+func Reject(w http.ResponseWriter, code int, msg string) {
+	response, _ := json.Marshal(map[string]string{"error": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// GRPCRequest wraps incoming gRPC metadata and the peer's TLS state in an
+// http.Request so the REST authenticators work unchanged for gRPC callers.
+func GRPCRequest(ctx context.Context, fullMethod string) *http.Request {
+	r := &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: fullMethod},
+		Header: http.Header{},
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for key, values := range md {
+			for _, value := range values {
+				r.Header.Add(key, value)
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := info.State
+			r.TLS = &state
+		}
+	}
+
+	return r.WithContext(ctx)
+}
@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// JWT verifies bearer tokens locally against a JWKS loaded from a file or an
+// http(s) URL. Remote key sets are reloaded every Refresh, and early when a
+// token names a key id we haven't seen.
+type JWT struct {
+	JWKS       string
+	Issuer     string
+	Audience   string
+	RolesClaim string
+	Refresh    time.Duration
+
+	mutex  sync.Mutex
+	keys   map[string]interface{}
+	loaded time.Time
+}
+
+type jwks struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	} `json:"keys"`
+}
+
+// Don't let unknown key ids hammer the JWKS endpoint
+const minRefresh = 30 * time.Second
+
+// Asymmetric algorithms we verify. HMAC and none are never accepted.
+var validMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if bearer == r.Header.Get("Authorization") || strings.Count(bearer, ".") != 2 {
+		return nil, ErrNoCredentials
+	}
+
+	//Tokens must expire, and must name us when we have an issuer or audience
+	opts := []jwt.ParserOption{jwt.WithValidMethods(validMethods), jwt.WithExpirationRequired()}
+	if len(j.Issuer) > 0 {
+		opts = append(opts, jwt.WithIssuer(j.Issuer))
+	}
+	if len(j.Audience) > 0 {
+		opts = append(opts, jwt.WithAudience(j.Audience))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(bearer, claims, j.keyFunc, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{Method: "jwt", Metadata: map[string]string{}}
+	identity.Name, _ = claims["sub"].(string)
+	if iss, ok := claims["iss"].(string); ok {
+		identity.Metadata["issuer"] = iss
+	}
+	switch roles := claims[j.RolesClaim].(type) {
+	case string:
+		identity.Roles = strings.Fields(roles)
+	case []interface{}:
+		for _, role := range roles {
+			identity.Roles = append(identity.Roles, fmt.Sprint(role))
+		}
+	}
+
+	return identity, nil
+}
+
+func (j *JWT) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	key, ok := j.keys[kid]
+	stale := time.Since(j.loaded) > j.Refresh
+	unknown := !ok && time.Since(j.loaded) > minRefresh
+	if j.keys == nil || stale || unknown {
+		if err := j.load(); err != nil {
+			//Keep verifying with the keys we have if a reload fails
+			if j.keys == nil {
+				return nil, err
+			}
+		}
+		key, ok = j.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("JWT key %q not in JWKS", kid)
+	}
+
+	return key, nil
+}
+
+// Callers must hold the mutex
+func (j *JWT) load() error {
+	var raw []byte
+	var err error
+	var set jwks
+
+	j.loaded = time.Now()
+	if strings.HasPrefix(j.JWKS, "http://") || strings.HasPrefix(j.JWKS, "https://") {
+		c := &http.Client{Timeout: 10 * time.Second}
+		resp, err := c.Get(j.JWKS)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return fmt.Errorf("Error getting JWKS: %s", resp.Status)
+		}
+		raw, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+	} else {
+		raw, err = ioutil.ReadFile(j.JWKS)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return err
+	}
+
+	keys := make(map[string]interface{})
+	for _, k := range set.Keys {
+		switch k.Kty {
+		case "RSA":
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return err
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch k.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				continue
+			}
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return err
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return err
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	j.keys = keys
+
+	return nil
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
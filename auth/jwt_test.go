@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+// Write a JWKS with an RSA key rsa-1 and an EC key ec-1
+func writeJWKS(t *testing.T, rsaKey *rsa.PrivateKey, ecKey *ecdsa.PrivateKey) string {
+	t.Helper()
+	set := map[string]interface{}{
+		"keys": []map[string]string{
+			{"kid": "rsa-1", "kty": "RSA", "n": encodeBigInt(rsaKey.N), "e": encodeBigInt(big.NewInt(int64(rsaKey.E)))},
+			{"kid": "ec-1", "kty": "EC", "crv": "P-256", "x": encodeBigInt(ecKey.X), "y": encodeBigInt(ecKey.Y)},
+			{"kid": "ec-unknown", "kty": "EC", "crv": "secp256k1"},
+		},
+	}
+	raw, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	authenticator := &JWT{
+		JWKS:       writeJWKS(t, rsaKey, ecKey),
+		Issuer:     "https://issuer.example.com/",
+		Audience:   "go-vault-demo",
+		RolesClaim: "roles",
+		Refresh:    time.Hour,
+	}
+
+	claims := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":   "lance",
+			"iss":   "https://issuer.example.com/",
+			"aud":   "go-vault-demo",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"roles": []string{"reader", "order"},
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, c jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, c)
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("SignedString() = %v", err)
+		}
+		return signed
+	}
+	publicKey := rsaKey.PublicKey.N.Bytes()
+
+	cases := []struct {
+		name          string
+		authorization string
+		want          *Identity
+		noCredentials bool
+	}{
+		{"rsa", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)),
+			&Identity{Name: "lance", Method: "jwt", Roles: []string{"reader", "order"}, Metadata: map[string]string{"issuer": "https://issuer.example.com/"}}, false},
+		{"ec", "Bearer " + sign(jwt.SigningMethodES256, "ec-1", ecKey, claims(nil)),
+			&Identity{Name: "lance", Method: "jwt", Roles: []string{"reader", "order"}, Metadata: map[string]string{"issuer": "https://issuer.example.com/"}}, false},
+		{"roles as a string", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["roles"] = "reader order" })),
+			&Identity{Name: "lance", Method: "jwt", Roles: []string{"reader", "order"}, Metadata: map[string]string{"issuer": "https://issuer.example.com/"}}, false},
+		{"expired", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), nil, false},
+		{"no expiry", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { delete(c, "exp") })), nil, false},
+		{"other issuer", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com/" })), nil, false},
+		{"other audience", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(func(c jwt.MapClaims) { c["aud"] = "someone-else" })), nil, false},
+		{"unknown key", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-2", rsaKey, claims(nil)), nil, false},
+		{"key from another kid", "Bearer " + sign(jwt.SigningMethodES256, "rsa-1", ecKey, claims(nil)), nil, false},
+		{"hmac with the public key", "Bearer " + sign(jwt.SigningMethodHS256, "rsa-1", publicKey, claims(nil)), nil, false},
+		{"none", "Bearer " + sign(jwt.SigningMethodNone, "rsa-1", jwt.UnsafeAllowNoneSignatureType, claims(nil)), nil, false},
+		{"tampered", "Bearer " + sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, claims(nil)) + "x", nil, false},
+		{"no header", "", nil, true},
+		{"vault token", "Bearer hvs.CAESIExample", nil, true},
+		{"basic auth", "Basic bGFuY2U6cGFzcw==", nil, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/orders", nil)
+			if len(c.authorization) > 0 {
+				r.Header.Set("Authorization", c.authorization)
+			}
+
+			identity, err := authenticator.Authenticate(r)
+			switch {
+			case c.noCredentials:
+				if err != ErrNoCredentials {
+					t.Errorf("Authenticate() = %v, want ErrNoCredentials", err)
+				}
+			case c.want == nil:
+				if err == nil || err == ErrNoCredentials {
+					t.Errorf("Authenticate() = %+v, %v, want a verification error", identity, err)
+				}
+			case err != nil:
+				t.Errorf("Authenticate() = %v", err)
+			case !reflect.DeepEqual(identity, c.want):
+				t.Errorf("Authenticate() = %+v, want %+v", identity, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Views of encrypted fields
+const (
+	Clear      = "clear"
+	Masked     = "mask"
+	Ciphertext = "ciphertext"
+)
+
+// Masking picks what callers without read-pii see of encrypted fields. A
+// view for one of the caller's roles wins over one for the named route,
+// which wins over the default.
+type Masking struct {
+	Policy  *Policy
+	Default string
+	Routes  map[string]string
+	Roles   map[string]string
+}
+
+// Validate makes sure config can't hand out clear text without read-pii
+func (m *Masking) Validate() error {
+	views := map[string]string{"default": m.Default}
+	for route, view := range m.Routes {
+		views["route "+route] = view
+	}
+	for role, view := range m.Roles {
+		views["role "+role] = view
+	}
+
+	for name, view := range views {
+		if view != Masked && view != Ciphertext {
+			return fmt.Errorf("Masking view %s for %s is not supported", view, name)
+		}
+	}
+
+	return nil
+}
+
+func (m *Masking) View(r *http.Request) string {
+	var name string
+	if route := mux.CurrentRoute(r); route != nil {
+		name = route.GetName()
+	}
+	return m.ViewFor(FromContext(r.Context()), name)
+}
+
+// ViewFor picks the view for a caller on a named route
+func (m *Masking) ViewFor(identity *Identity, route string) string {
+	if m.Policy.Allowed(identity, ReadPII) {
+		return Clear
+	}
+
+	if identity != nil {
+		for _, role := range m.Policy.roles(identity) {
+			if view, ok := m.Roles[role]; ok {
+				return view
+			}
+		}
+	}
+	if view, ok := m.Routes[route]; ok {
+		return view
+	}
+
+	return m.Default
+}
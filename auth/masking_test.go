@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMaskingValidate(t *testing.T) {
+	cases := []struct {
+		name    string
+		masking Masking
+		wantErr bool
+	}{
+		{"defaults", Masking{Default: Masked}, false},
+		{"every view", Masking{Default: Ciphertext, Routes: map[string]string{"orders": Masked}, Roles: map[string]string{"reader": Ciphertext}}, false},
+		{"clear default", Masking{Default: Clear}, true},
+		{"empty default", Masking{}, true},
+		{"clear route", Masking{Default: Masked, Routes: map[string]string{"orders": Clear}}, true},
+		{"unknown role view", Masking{Default: Masked, Roles: map[string]string{"reader": "redact"}}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.masking.Validate(); (err != nil) != c.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestMaskingViewFor(t *testing.T) {
+	masking := &Masking{
+		Policy: &Policy{
+			Roles: map[string][]string{
+				"admin":   {ReadMasked, ReadPII},
+				"reader":  {ReadMasked},
+				"auditor": {ReadMasked},
+			},
+			MetadataKey: "app_roles",
+		},
+		Default: Masked,
+		Routes:  map[string]string{"orders-export": Ciphertext},
+		Roles:   map[string]string{"auditor": Ciphertext},
+	}
+
+	cases := []struct {
+		name     string
+		identity *Identity
+		route    string
+		want     string
+	}{
+		{"read-pii", &Identity{Method: "jwt", Roles: []string{"admin"}}, "orders-export", Clear},
+		{"default", &Identity{Method: "jwt", Roles: []string{"reader"}}, "orders", Masked},
+		{"route", &Identity{Method: "jwt", Roles: []string{"reader"}}, "orders-export", Ciphertext},
+		{"role over default", &Identity{Method: "jwt", Roles: []string{"auditor"}}, "orders", Ciphertext},
+		{"role from vault metadata", &Identity{Method: "vault", Metadata: map[string]string{"app_roles": "auditor"}}, "orders", Ciphertext},
+		{"anonymous", nil, "orders", Masked},
+		{"anonymous on route", nil, "orders-export", Ciphertext},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := masking.ViewFor(c.identity, c.route); got != c.want {
+				t.Errorf("ViewFor(%+v, %q) = %q, want %q", c.identity, c.route, got, c.want)
+			}
+		})
+	}
+}
+
+func TestMaskingViewUsesRouteName(t *testing.T) {
+	masking := &Masking{Policy: &Policy{}, Default: Masked, Routes: map[string]string{"orders-export": Ciphertext}}
+
+	var view string
+	r := mux.NewRouter()
+	r.HandleFunc("/orders:export", func(w http.ResponseWriter, r *http.Request) {
+		view = masking.View(r)
+	}).Name("orders-export")
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/orders:export", nil))
+
+	if view != Ciphertext {
+		t.Errorf("View() = %q, want %q", view, Ciphertext)
+	}
+}
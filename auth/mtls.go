@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"net/http"
+)
+
+// ClientCert identifies callers by a verified TLS client certificate. The
+// subject common name is the caller and organizational units are its roles.
+type ClientCert struct{}
+
+func (c *ClientCert) Authenticate(r *http.Request) (*Identity, error) {
+	//Only chains the listener verified count
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	cert := r.TLS.VerifiedChains[0][0]
+	identity := &Identity{
+		Name:     cert.Subject.CommonName,
+		Method:   "mtls",
+		Roles:    cert.Subject.OrganizationalUnit,
+		Metadata: map[string]string{"serial": cert.SerialNumber.String()},
+	}
+
+	return identity, nil
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Operations a route can require
+const (
+	ReadMasked = "read-masked"
+	ReadPII    = "read-pii"
+	Create     = "create"
+	Update     = "update"
+	Delete     = "delete"
+	Admin      = "admin"
+)
+
+// Policy grants operations to roles. A caller's roles are its JWT or
+// certificate roles, its Vault policies, the comma separated value of
+// MetadataKey in its Vault entity metadata, and the roles of any User
+// matching it.
+type Policy struct {
+	Roles       map[string][]string
+	Users       []User
+	MetadataKey string
+}
+
+// User grants roles to one caller. The method is part of the match so a JWT
+// subject can't claim a Vault caller's grants. Vault callers are named by
+// entity ID since display names come from whatever the login used. Names are
+// compared exactly.
+type User struct {
+	Method string
+	Name   string
+	Roles  []string
+}
+
+func (p *Policy) Allowed(identity *Identity, operation string) bool {
+	if identity == nil {
+		return false
+	}
+
+	for _, role := range p.roles(identity) {
+		for _, op := range p.Roles[role] {
+			if op == operation {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Require rejects callers that aren't allowed any of the operations with a 403
+func (p *Policy) Require(operations ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity := FromContext(r.Context())
+			for _, operation := range operations {
+				if p.Allowed(identity, operation) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if identity != nil {
+				log.WithFields(log.Fields{
+					"method":      r.Method,
+					"path":        r.URL.Path,
+					"auth_method": identity.Method,
+					"caller":      identity.Name,
+				}).Warn("Denied request")
+			}
+			Reject(w, http.StatusForbidden, "Forbidden")
+		})
+	}
+}
+
+func (p *Policy) roles(identity *Identity) []string {
+	var roles []string
+
+	roles = append(roles, identity.Roles...)
+	roles = append(roles, identity.Policies...)
+	name := grantName(identity)
+	for _, user := range p.Users {
+		if len(name) > 0 && user.Method == identity.Method && user.Name == name {
+			roles = append(roles, user.Roles...)
+		}
+	}
+	if len(p.MetadataKey) > 0 && identity.Method == "vault" {
+		for _, role := range strings.Split(identity.Metadata[p.MetadataKey], ",") {
+			if role = strings.TrimSpace(role); len(role) > 0 {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return roles
+}
+
+// The name users are matched against, empty for callers that can't have grants
+func grantName(identity *Identity) string {
+	if identity.Method == "vault" {
+		return identity.EntityID
+	}
+	return identity.Name
+}
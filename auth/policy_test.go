@@ -0,0 +1,50 @@
+package auth
+
+import "testing"
+
+func TestPolicyAllowed(t *testing.T) {
+	policy := &Policy{
+		Roles: map[string][]string{
+			"admin":  {ReadMasked, ReadPII, Create, Update, Delete, Admin},
+			"order":  {ReadMasked, ReadPII, Create, Update},
+			"reader": {ReadMasked},
+		},
+		Users: []User{
+			{Method: "mtls", Name: "orders.svc.example.com", Roles: []string{"order"}},
+			{Method: "jwt", Name: "Alice", Roles: []string{"admin"}},
+			{Method: "vault", Name: "5f6c8a0e-entity", Roles: []string{"admin"}},
+		},
+		MetadataKey: "app_roles",
+	}
+
+	cases := []struct {
+		name      string
+		identity  *Identity
+		operation string
+		want      bool
+	}{
+		{"anonymous", nil, ReadMasked, false},
+		{"dotted common name", &Identity{Method: "mtls", Name: "orders.svc.example.com"}, Create, true},
+		{"dotted common name without grant", &Identity{Method: "mtls", Name: "orders.svc.example.com"}, Delete, false},
+		{"common name prefix", &Identity{Method: "mtls", Name: "orders"}, Create, false},
+		{"mixed case subject", &Identity{Method: "jwt", Name: "Alice"}, Delete, true},
+		{"subject case differs", &Identity{Method: "jwt", Name: "alice"}, Delete, false},
+		{"name under another method", &Identity{Method: "mtls", Name: "Alice"}, Delete, false},
+		{"vault entity", &Identity{Method: "vault", Name: "anyone", EntityID: "5f6c8a0e-entity"}, Admin, true},
+		{"vault display name", &Identity{Method: "vault", Name: "5f6c8a0e-entity"}, Admin, false},
+		{"jwt subject claiming an entity", &Identity{Method: "jwt", Name: "5f6c8a0e-entity"}, Admin, false},
+		{"role", &Identity{Method: "jwt", Name: "bob", Roles: []string{"reader"}}, ReadMasked, true},
+		{"role without operation", &Identity{Method: "jwt", Name: "bob", Roles: []string{"reader"}}, ReadPII, false},
+		{"vault policy", &Identity{Method: "vault", Policies: []string{"order"}}, Update, true},
+		{"vault metadata", &Identity{Method: "vault", Metadata: map[string]string{"app_roles": "reader, order"}}, ReadPII, true},
+		{"metadata outside vault", &Identity{Method: "jwt", Metadata: map[string]string{"app_roles": "admin"}}, Admin, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := policy.Allowed(c.identity, c.operation); got != c.want {
+				t.Errorf("Allowed(%+v, %q) = %v, want %v", c.identity, c.operation, got, c.want)
+			}
+		})
+	}
+}
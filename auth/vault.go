@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/client"
+)
+
+// Upper bound on cached token lookups
+const maxCachedTokens = 4096
+
+// VaultToken identifies callers by looking up their Vault token. Lookups are
+// cached for CacheTTL or until the token expires, whichever is sooner.
+type VaultToken struct {
+	Vault    *client.Vault
+	CacheTTL time.Duration
+
+	mutex  sync.Mutex
+	tokens map[string]cachedIdentity
+}
+
+type cachedIdentity struct {
+	Identity *Identity
+	Expires  time.Time
+}
+
+func (v *VaultToken) Authenticate(r *http.Request) (*Identity, error) {
+	token := r.Header.Get("X-Vault-Token")
+	if len(token) == 0 {
+		//Bearer JWTs are left for the JWT authenticator
+		bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if bearer != r.Header.Get("Authorization") && strings.Count(bearer, ".") != 2 {
+			token = bearer
+		}
+	}
+	if len(token) == 0 {
+		return nil, ErrNoCredentials
+	}
+
+	//Never keep the raw token around
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	v.mutex.Lock()
+	cached, ok := v.tokens[key]
+	v.mutex.Unlock()
+	if ok && time.Now().Before(cached.Expires) {
+		return cached.Identity, nil
+	}
+
+	lookup, err := v.Vault.LookupToken(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+
+	identity := &Identity{Method: "vault", Metadata: map[string]string{}}
+	identity.Name, _ = lookup.Data["display_name"].(string)
+	identity.EntityID, _ = lookup.Data["entity_id"].(string)
+	if policies, ok := lookup.Data["policies"].([]interface{}); ok {
+		for _, policy := range policies {
+			identity.Policies = append(identity.Policies, fmt.Sprint(policy))
+		}
+	}
+
+	//Token meta can be set by whoever logs in, so only trust the entity's
+	if len(identity.EntityID) > 0 {
+		entity, err := v.Vault.ReadEntity(r.Context(), identity.EntityID)
+		if err != nil {
+			return nil, err
+		}
+		if meta, ok := entity.Data["metadata"].(map[string]interface{}); ok {
+			for k, val := range meta {
+				identity.Metadata[k] = fmt.Sprint(val)
+			}
+		}
+	}
+
+	//Don't cache past the token's own expiry
+	expires := time.Now().Add(v.CacheTTL)
+	if expireTime, ok := lookup.Data["expire_time"].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, expireTime); err == nil && t.Before(expires) {
+			expires = t
+		}
+	}
+	v.cache(key, cachedIdentity{Identity: identity, Expires: expires})
+
+	return identity, nil
+}
+
+func (v *VaultToken) cache(key string, entry cachedIdentity) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.tokens == nil {
+		v.tokens = make(map[string]cachedIdentity)
+	}
+
+	//Drop expired lookups, then start over if we are still full
+	if len(v.tokens) >= maxCachedTokens {
+		for k, cached := range v.tokens {
+			if time.Now().After(cached.Expires) {
+				delete(v.tokens, k)
+			}
+		}
+		if len(v.tokens) >= maxCachedTokens {
+			v.tokens = make(map[string]cachedIdentity)
+		}
+	}
+
+	v.tokens[key] = entry
+}
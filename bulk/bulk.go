@@ -0,0 +1,365 @@
+// Package bulk reads and writes orders as NDJSON or CSV for imports and
+// exports. Rows are handled one at a time so neither side holds a whole
+// file in memory.
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+// Formats we read and write
+const (
+	NDJSON = "ndjson"
+	CSV    = "csv"
+)
+
+// Longest NDJSON line we accept
+const maxLine = 1 << 20
+
+// CSV columns. Imports need a header naming some of them, exports write all
+// of them. Items are a JSON array of line items like NDJSON rows carry.
+var (
+	importColumns = []string{"CustomerName", "ProductName", "OrderDate", "Status", "Items"}
+	exportColumns = []string{"id", "CustomerId", "CustomerName", "ProductName", "OrderDate", "Status", "Total", "Currency", "Tampered", "Items"}
+)
+
+// RowError is a row that couldn't be parsed. The rest of the input can
+// still be read.
+type RowError struct {
+	Reason string
+}
+
+func (e *RowError) Error() string {
+	return e.Reason
+}
+
+// FormatError is input that can't be read in its format at all, like a CSV
+// without a usable header or an NDJSON line over the size limit. Nothing
+// after it can be read.
+type FormatError struct {
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return e.Reason
+}
+
+// Reader returns one order per row, a *RowError for a row that can't be
+// parsed, or io.EOF once the input is done. Line is the input line of the
+// last row read.
+type Reader interface {
+	Read() (models.Order, error)
+	Line() int
+}
+
+// Writer writes one order per row
+type Writer interface {
+	Write(order models.Order) error
+	Flush() error
+}
+
+// Format picks the format for a media type like application/x-ndjson
+func Format(contentType string) (string, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", false
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/ndjson":
+		return NDJSON, true
+	case "text/csv":
+		return CSV, true
+	}
+	return "", false
+}
+
+func ContentType(format string) string {
+	if format == CSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+func NewReader(format string, r io.Reader) (Reader, error) {
+	switch format {
+	case NDJSON:
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxLine)
+		return &ndjsonReader{scanner: scanner}, nil
+	case CSV:
+		return newCSVReader(r)
+	}
+	return nil, &FormatError{Reason: fmt.Sprintf("Bulk format %s is not supported", format)}
+}
+
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case NDJSON:
+		return &ndjsonWriter{w: bufio.NewWriter(w)}, nil
+	case CSV:
+		return &csvWriter{w: csv.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("Bulk format %s is not supported", format)
+}
+
+// What an import row may carry. Ids, signatures and totals are ours to set.
+type row struct {
+	CustomerName string
+	ProductName  string
+	Items        []rowItem
+	OrderDate    time.Time
+	Status       string
+}
+
+type rowItem struct {
+	Sku       string
+	Quantity  int64
+	UnitPrice int64
+	Currency  string
+}
+
+func lineItems(items []rowItem) []models.LineItem {
+	var lineItems []models.LineItem
+	for _, item := range items {
+		lineItems = append(lineItems, models.LineItem{
+			Sku:       item.Sku,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Currency:  item.Currency,
+		})
+	}
+	return lineItems
+}
+
+type ndjsonReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (r *ndjsonReader) Read() (models.Order, error) {
+	var order models.Order
+
+	//Blank lines aren't rows
+	for r.scanner.Scan() {
+		r.line++
+		text := bytes.TrimSpace(r.scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		var parsed row
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&parsed); err != nil {
+			return order, &RowError{Reason: err.Error()}
+		}
+		if decoder.More() {
+			return order, &RowError{Reason: "line holds more than one JSON object"}
+		}
+
+		order = models.Order{
+			CustomerName: parsed.CustomerName,
+			ProductName:  parsed.ProductName,
+			OrderDate:    parsed.OrderDate,
+			Status:       parsed.Status,
+			Items:        lineItems(parsed.Items),
+		}
+		return order, nil
+	}
+
+	if err := r.scanner.Err(); err == bufio.ErrTooLong {
+		return order, &FormatError{Reason: fmt.Sprintf("Line %d is longer than %d bytes", r.line+1, maxLine)}
+	} else if err != nil {
+		return order, err
+	}
+	return order, io.EOF
+}
+
+func (r *ndjsonReader) Line() int {
+	return r.line
+}
+
+type csvReader struct {
+	r       *csv.Reader
+	columns map[string]int
+	line    int
+}
+
+// The header names the columns in any order
+func newCSVReader(r io.Reader) (*csvReader, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, &FormatError{Reason: "CSV import is empty"}
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return nil, &FormatError{Reason: fmt.Sprintf("Unable to read CSV header: %s", parseErr.Err)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		known := false
+		for _, column := range importColumns {
+			if strings.EqualFold(name, column) {
+				columns[column] = i
+				known = true
+			}
+		}
+		if !known {
+			return nil, &FormatError{Reason: fmt.Sprintf("CSV column %q is not supported", name)}
+		}
+	}
+	if _, ok := columns["CustomerName"]; !ok {
+		return nil, &FormatError{Reason: "CSV header needs a CustomerName column"}
+	}
+
+	return &csvReader{r: reader, columns: columns, line: 1}, nil
+}
+
+func (r *csvReader) Read() (models.Order, error) {
+	var order models.Order
+
+	record, err := r.r.Read()
+	if err == io.EOF {
+		return order, io.EOF
+	}
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		r.line = parseErr.StartLine
+		return order, &RowError{Reason: parseErr.Err.Error()}
+	}
+	if err != nil {
+		return order, err
+	}
+	r.line, _ = r.r.FieldPos(0)
+
+	field := func(column string) string {
+		if i, ok := r.columns[column]; ok && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+
+	order.CustomerName = field("CustomerName")
+	order.ProductName = field("ProductName")
+	order.Status = field("Status")
+	if date := strings.TrimSpace(field("OrderDate")); len(date) > 0 {
+		order.OrderDate, err = time.Parse(time.RFC3339Nano, date)
+		if err != nil {
+			return order, &RowError{Reason: "OrderDate must be an RFC 3339 timestamp"}
+		}
+	}
+	if items := strings.TrimSpace(field("Items")); len(items) > 0 {
+		var parsed []rowItem
+		decoder := json.NewDecoder(strings.NewReader(items))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&parsed); err != nil || decoder.More() {
+			return order, &RowError{Reason: "Items must be a JSON array of line items with Sku, Quantity, UnitPrice and Currency"}
+		}
+		order.Items = lineItems(parsed)
+	}
+
+	return order, nil
+}
+
+func (r *csvReader) Line() int {
+	return r.line
+}
+
+type ndjsonWriter struct {
+	w *bufio.Writer
+}
+
+func (w *ndjsonWriter) Write(order models.Order) error {
+	line, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	_, err = w.w.Write(line)
+	return err
+}
+
+func (w *ndjsonWriter) Flush() error {
+	return w.w.Flush()
+}
+
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+}
+
+func (w *csvWriter) Write(order models.Order) error {
+	if !w.header {
+		if err := w.w.Write(exportColumns); err != nil {
+			return err
+		}
+		w.header = true
+	}
+
+	var customerId, total, items string
+	if order.CustomerId > 0 {
+		customerId = strconv.FormatInt(order.CustomerId, 10)
+	}
+	if len(order.Items) > 0 {
+		total = strconv.FormatInt(order.Total, 10)
+		encoded, err := json.Marshal(order.Items)
+		if err != nil {
+			return err
+		}
+		items = string(encoded)
+	}
+
+	return w.w.Write([]string{
+		strconv.FormatInt(order.Id, 10),
+		customerId,
+		cell(order.CustomerName),
+		cell(order.ProductName),
+		order.OrderDate.UTC().Format(time.RFC3339Nano),
+		order.Status,
+		total,
+		order.Currency,
+		strconv.FormatBool(order.Tampered),
+		cell(items),
+	})
+}
+
+// An export with no orders still gets its header
+func (w *csvWriter) Flush() error {
+	if !w.header {
+		if err := w.w.Write(exportColumns); err != nil {
+			return err
+		}
+		w.header = true
+	}
+	w.w.Flush()
+	return w.w.Error()
+}
+
+// Spreadsheets run cells that start like a formula, so quote them as text
+func cell(value string) string {
+	if len(value) > 0 && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
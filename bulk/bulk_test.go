@@ -0,0 +1,235 @@
+package bulk
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+// What a reader returned for one row
+type result struct {
+	order models.Order
+	err   string
+	line  int
+}
+
+// Read every row until io.EOF or an error that ends the input
+func readAll(t *testing.T, reader Reader) []result {
+	t.Helper()
+	var results []result
+	for {
+		order, err := reader.Read()
+		if err == io.EOF {
+			return results
+		}
+		r := result{order: order, line: reader.Line()}
+		if err != nil {
+			r = result{err: err.Error(), line: reader.Line()}
+		}
+		results = append(results, r)
+		if _, ok := err.(*RowError); err != nil && !ok {
+			return results
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	cases := []struct {
+		contentType string
+		want        string
+		ok          bool
+	}{
+		{"application/x-ndjson", NDJSON, true},
+		{"application/ndjson; charset=utf-8", NDJSON, true},
+		{"text/csv", CSV, true},
+		{"Text/CSV; header=present", CSV, true},
+		{"application/json", "", false},
+		{"", "", false},
+		{"text/csv;;", "", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.contentType, func(t *testing.T) {
+			got, ok := Format(c.contentType)
+			if got != c.want || ok != c.ok {
+				t.Errorf("Format(%q) = %q, %v, want %q, %v", c.contentType, got, ok, c.want, c.ok)
+			}
+		})
+	}
+}
+
+func TestNDJSONReader(t *testing.T) {
+	date := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		input string
+		want  []result
+	}{
+		{"empty", "", nil},
+		{"orders", "{\"CustomerName\":\"Lance\",\"ProductName\":\"Vault\",\"OrderDate\":\"2019-03-01T12:00:00Z\",\"Status\":\"paid\"}\n\n  \n{\"CustomerName\":\"Bob\",\"ProductName\":\"Consul\"}",
+			[]result{
+				{order: models.Order{CustomerName: "Lance", ProductName: "Vault", OrderDate: date, Status: "paid"}, line: 1},
+				{order: models.Order{CustomerName: "Bob", ProductName: "Consul"}, line: 4},
+			}},
+		{"items", `{"CustomerName":"Lance","Items":[{"Sku":"vault-ent","Quantity":2,"UnitPrice":500,"Currency":"USD"}]}`,
+			[]result{{order: models.Order{CustomerName: "Lance", Items: []models.LineItem{{Sku: "vault-ent", Quantity: 2, UnitPrice: 500, Currency: "USD"}}}, line: 1}}},
+		{"bad rows", "{\"CustomerName\":\"Lance\",\"id\":5}\nnot json\n{} {}\n{\"CustomerName\":\"Bob\"}",
+			[]result{
+				{err: `json: unknown field "id"`, line: 1},
+				{err: "invalid character 'o' in literal null (expecting 'u')", line: 2},
+				{err: "line holds more than one JSON object", line: 3},
+				{order: models.Order{CustomerName: "Bob"}, line: 4},
+			}},
+		{"line too long", "{\"CustomerName\":\"Lance\"}\n" + strings.Repeat(" ", maxLine+1) + "\n{}",
+			[]result{
+				{order: models.Order{CustomerName: "Lance"}, line: 1},
+				{err: "Line 2 is longer than 1048576 bytes", line: 1},
+			}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reader, err := NewReader(NDJSON, strings.NewReader(c.input))
+			if err != nil {
+				t.Fatalf("NewReader() = %v", err)
+			}
+			if got := readAll(t, reader); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Read() = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCSVReader(t *testing.T) {
+	date := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name      string
+		input     string
+		want      []result
+		formatErr string
+	}{
+		{"orders", "CustomerName,ProductName,OrderDate,Status\nLance,Vault,2019-03-01T12:00:00Z,paid\n\"O'Brien, Zoë\",Consul,,\n",
+			[]result{
+				{order: models.Order{CustomerName: "Lance", ProductName: "Vault", OrderDate: date, Status: "paid"}, line: 2},
+				{order: models.Order{CustomerName: "O'Brien, Zoë", ProductName: "Consul"}, line: 3},
+			}, ""},
+		{"columns in any order and case", " productname ,CUSTOMERNAME\nVault,Lance\n",
+			[]result{{order: models.Order{CustomerName: "Lance", ProductName: "Vault"}, line: 2}}, ""},
+		{"short row", "CustomerName,ProductName\nLance\n",
+			[]result{{order: models.Order{CustomerName: "Lance"}, line: 2}}, ""},
+		{"bad rows", "CustomerName,OrderDate\nLance,yesterday\n\"Lance,\nBob,\n",
+			[]result{
+				{err: "OrderDate must be an RFC 3339 timestamp", line: 2},
+				{err: "extraneous or missing \" in quoted-field", line: 3},
+			}, ""},
+		{"items", "CustomerName,Items\nLance,\"[{\"\"Sku\"\":\"\"vault-ent\"\",\"\"Quantity\"\":2,\"\"UnitPrice\"\":500,\"\"Currency\"\":\"\"USD\"\"}]\"\nBob, \n",
+			[]result{
+				{order: models.Order{CustomerName: "Lance", Items: []models.LineItem{{Sku: "vault-ent", Quantity: 2, UnitPrice: 500, Currency: "USD"}}}, line: 2},
+				{order: models.Order{CustomerName: "Bob"}, line: 3},
+			}, ""},
+		{"bad items", "CustomerName,Items\nLance,vault-ent\nLance,\"[{\"\"Total\"\":1}]\"\nLance,[] []\n",
+			[]result{
+				{err: "Items must be a JSON array of line items with Sku, Quantity, UnitPrice and Currency", line: 2},
+				{err: "Items must be a JSON array of line items with Sku, Quantity, UnitPrice and Currency", line: 3},
+				{err: "Items must be a JSON array of line items with Sku, Quantity, UnitPrice and Currency", line: 4},
+			}, ""},
+		{"empty", "", nil, "CSV import is empty"},
+		{"unknown column", "CustomerName,id\n", nil, `CSV column "id" is not supported`},
+		{"no customer column", "ProductName\nVault\n", nil, "CSV header needs a CustomerName column"},
+		{"bad header", "\"CustomerName\n", nil, "Unable to read CSV header: extraneous or missing \" in quoted-field"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			reader, err := NewReader(CSV, strings.NewReader(c.input))
+			if len(c.formatErr) > 0 {
+				if _, ok := err.(*FormatError); !ok || err.Error() != c.formatErr {
+					t.Fatalf("NewReader() = %v, want FormatError %q", err, c.formatErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewReader() = %v", err)
+			}
+			if got := readAll(t, reader); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("Read() = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCell(t *testing.T) {
+	cases := []struct {
+		value string
+		want  string
+	}{
+		{"", ""},
+		{"Lance", "Lance"},
+		{"=HYPERLINK(\"http://example.com\")", "'=HYPERLINK(\"http://example.com\")"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\tLance", "'\tLance"},
+		{"\rLance", "'\rLance"},
+		{"Lance=1", "Lance=1"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.value, func(t *testing.T) {
+			if got := cell(c.value); got != c.want {
+				t.Errorf("cell(%q) = %q, want %q", c.value, got, c.want)
+			}
+		})
+	}
+}
+
+func TestWriter(t *testing.T) {
+	date := time.Date(2019, 3, 1, 7, 0, 0, 0, time.FixedZone("EST", -5*60*60))
+	orders := []models.Order{
+		{Id: 1, CustomerName: "=cmd", ProductName: "Vault", OrderDate: date, Status: "paid"},
+		{Id: 2, CustomerId: 7, CustomerName: "L***e", OrderDate: date, Status: "created", Tampered: true,
+			Items: []models.LineItem{{Sku: "vault-ent", Quantity: 2, UnitPrice: 500, Currency: "USD", Total: 1000}}, Total: 1000, Currency: "USD"},
+	}
+
+	cases := []struct {
+		name   string
+		format string
+		orders []models.Order
+		want   string
+	}{
+		{"csv", CSV, orders, "id,CustomerId,CustomerName,ProductName,OrderDate,Status,Total,Currency,Tampered,Items\n" +
+			"1,,'=cmd,Vault,2019-03-01T12:00:00Z,paid,,,false,\n" +
+			"2,7,L***e,,2019-03-01T12:00:00Z,created,1000,USD,true,\"[{\"\"Sku\"\":\"\"vault-ent\"\",\"\"Quantity\"\":2,\"\"UnitPrice\"\":500,\"\"Currency\"\":\"\"USD\"\",\"\"Total\"\":1000}]\"\n"},
+		{"empty csv", CSV, nil, "id,CustomerId,CustomerName,ProductName,OrderDate,Status,Total,Currency,Tampered,Items\n"},
+		{"ndjson", NDJSON, orders[:1], `{"id":1,"CustomerName":"=cmd","ProductName":"Vault","OrderDate":"2019-03-01T07:00:00-05:00","Status":"paid"}` + "\n"},
+		{"empty ndjson", NDJSON, nil, ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var out bytes.Buffer
+			writer, err := NewWriter(c.format, &out)
+			if err != nil {
+				t.Fatalf("NewWriter() = %v", err)
+			}
+			for _, order := range c.orders {
+				if err := writer.Write(order); err != nil {
+					t.Fatalf("Write() = %v", err)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				t.Fatalf("Flush() = %v", err)
+			}
+			if out.String() != c.want {
+				t.Errorf("output = %q, want %q", out.String(), c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Package certs holds the TLS listener's certificate. Certificates issued by
+// Vault PKI are reissued before they expire and swapped in for new
+// handshakes without restarting the listener.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/client"
+	log "github.com/sirupsen/logrus"
+)
+
+// Store serves whichever certificate was loaded last
+type Store struct {
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.cert == nil {
+		return nil, errors.New("No TLS certificate loaded.")
+	}
+	return s.cert, nil
+}
+
+// LoadFiles loads a static PEM certificate and key pair
+func (s *Store) LoadFiles(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	_, err = s.set(&cert)
+	return err
+}
+
+// Swap in a new certificate and return when it expires
+func (s *Store) set(cert *tls.Certificate) (time.Time, error) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return time.Time{}, err
+	}
+	cert.Leaf = leaf
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cert = cert
+
+	return leaf.NotAfter, nil
+}
+
+// PKI issues the listener certificate from a Vault PKI role
+type PKI struct {
+	Vault      *client.Vault
+	Mount      string
+	Role       string
+	CommonName string
+	AltNames   []string
+	TTL        time.Duration
+	Store      *Store
+}
+
+// Wait this long before retrying a failed reissue
+const retryInterval = 30 * time.Second
+
+// Issue gets a new certificate and swaps it into the store
+func (p *PKI) Issue() (time.Time, time.Time, error) {
+	chain, key, err := p.Vault.IssueCertificate(fmt.Sprintf("%s/issue/%s", p.Mount, p.Role), p.CommonName, p.AltNames, p.TTL)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	cert, err := tls.X509KeyPair([]byte(chain), []byte(key))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	notAfter, err := p.Store.set(&cert)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	log.WithFields(log.Fields{
+		"common_name": p.CommonName,
+		"serial":      cert.Leaf.SerialNumber.String(),
+		"expires":     notAfter,
+	}).Info("Issued TLS certificate")
+	return cert.Leaf.NotBefore, notAfter, nil
+}
+
+// Renew reissues the certificate once two thirds of its lifetime has passed.
+// Failures are retried and the current certificate stays in use meanwhile.
+func (p *PKI) Renew(notBefore time.Time, notAfter time.Time) {
+	for {
+		time.Sleep(time.Until(notBefore.Add(notAfter.Sub(notBefore) * 2 / 3)))
+
+		for {
+			issued, expires, err := p.Issue()
+			if err == nil {
+				notBefore, notAfter = issued, expires
+				break
+			}
+			log.WithError(err).WithField("expires", notAfter).Error("Unable to reissue TLS certificate")
+			time.Sleep(retryInterval)
+		}
+	}
+}
+
+// ServerConfig builds the listener config. Client certificates are checked
+// against the CAs in clientCA when clientAuth is request or require.
+func ServerConfig(store *Store, clientAuth string, clientCA string) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: store.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	switch clientAuth {
+	case "none":
+		return config, nil
+	case "request":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("TLS client auth %s is not supported", clientAuth)
+	}
+
+	if len(clientCA) == 0 {
+		return nil, errors.New("Could not get TLS client CA from config.")
+	}
+	pem, err := ioutil.ReadFile(clientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %s", clientCA)
+	}
+	config.ClientCAs = pool
+
+	return config, nil
+}
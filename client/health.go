@@ -0,0 +1,100 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/dimiro1/health"
+	"github.com/lanceplarsen/go-vault-demo/metrics"
+)
+
+// Expiry of every lease we hold, refreshed on each renewal
+var leases = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+func trackLease(leaseID string, ttl int) {
+	metrics.SetLeaseTTL(leasePath(leaseID), ttl)
+
+	leases.Lock()
+	defer leases.Unlock()
+	leases.expires[leaseID] = time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// SysChecker reports Vault's own view of its health from sys/health
+func (v *Vault) SysChecker() health.Checker {
+	return health.CheckerFunc(func() health.Health {
+		h := health.NewHealth()
+
+		status, err := client.Sys().Health()
+		if err != nil {
+			h.Down()
+			h.AddInfo("error", err.Error())
+			return h
+		}
+		h.AddInfo("initialized", status.Initialized)
+		h.AddInfo("sealed", status.Sealed)
+		h.AddInfo("standby", status.Standby)
+		h.AddInfo("version", status.Version)
+
+		if !status.Initialized || status.Sealed {
+			h.Down()
+		} else {
+			h.Up()
+		}
+		return h
+	})
+}
+
+// TokenChecker looks up our own token and reports how long it has left
+func (v *Vault) TokenChecker() health.Checker {
+	return health.CheckerFunc(func() health.Health {
+		h := health.NewHealth()
+
+		lookup, err := client.Auth().Token().LookupSelf()
+		if err != nil {
+			h.Down()
+			h.AddInfo("error", err.Error())
+			return h
+		}
+		ttl, err := lookup.TokenTTL()
+		if err != nil {
+			h.Down()
+			h.AddInfo("error", err.Error())
+			return h
+		}
+		renewable, _ := lookup.TokenIsRenewable()
+		h.AddInfo("ttl", ttl.String())
+		h.AddInfo("renewable", renewable)
+
+		//Root tokens have no expire time and a zero TTL
+		expires, _ := lookup.Data["expire_time"].(string)
+		if ttl <= 0 && len(expires) > 0 {
+			h.Down()
+		} else {
+			h.Up()
+		}
+		return h
+	})
+}
+
+// LeaseChecker reports the time left on every secret lease we hold
+func (v *Vault) LeaseChecker() health.Checker {
+	return health.CheckerFunc(func() health.Health {
+		h := health.NewHealth()
+		h.Up()
+
+		leases.Lock()
+		defer leases.Unlock()
+		for leaseID, expires := range leases.expires {
+			remaining := time.Until(expires)
+			if remaining <= 0 {
+				h.Down()
+				remaining = 0
+			}
+			h.AddInfo(leasePath(leaseID), remaining.Truncate(time.Second).String())
+		}
+		return h
+	})
+}
@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// IssueCertificate issues a certificate from a PKI issue path. The returned
+// chain has the leaf first followed by the issuing CAs.
+func (v *Vault) IssueCertificate(path string, commonName string, altNames []string, ttl time.Duration) (string, string, error) {
+	data := map[string]interface{}{"common_name": commonName}
+	if len(altNames) > 0 {
+		data["alt_names"] = strings.Join(altNames, ",")
+	}
+	if ttl > 0 {
+		data["ttl"] = ttl.String()
+	}
+
+	secret, err := client.Logical().Write(path, data)
+	if err != nil {
+		return "", "", err
+	}
+	if secret == nil {
+		return "", "", errors.New("Empty response from PKI issue.")
+	}
+
+	cert, _ := secret.Data["certificate"].(string)
+	key, _ := secret.Data["private_key"].(string)
+	if len(cert) == 0 || len(key) == 0 {
+		return "", "", fmt.Errorf("No certificate returned from %s", path)
+	}
+
+	chain := []string{cert}
+	if cas, ok := secret.Data["ca_chain"].([]interface{}); ok && len(cas) > 0 {
+		for _, ca := range cas {
+			chain = append(chain, fmt.Sprint(ca))
+		}
+	} else if ca, ok := secret.Data["issuing_ca"].(string); ok {
+		chain = append(chain, ca)
+	}
+
+	return strings.Join(chain, "\n"), key, nil
+}
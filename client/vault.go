@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -19,6 +18,10 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	. "github.com/hashicorp/vault/api"
+	"github.com/lanceplarsen/go-vault-demo/metrics"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/iam/v1"
@@ -41,6 +44,11 @@ type Credential struct {
 	ServiceAccount string
 }
 
+// Keep the token and secret id out of anything that formats a Credential
+func (c Credential) String() string {
+	return fmt.Sprintf("{RoleID:%s ServiceAccount:%s}", c.RoleID, c.ServiceAccount)
+}
+
 type msiResponseJson struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
@@ -53,11 +61,17 @@ type msiResponseJson struct {
 
 var client *Client
 
-func (v *Vault) Initialize() error {
-	var err error
+var errBatchRejected = errors.New("Transit rejected every item in the batch.")
+
+func (v *Vault) Initialize() (err error) {
 	var renew bool
 	var token string
 
+	//Count every login attempt
+	defer func() {
+		metrics.Login(v.Authentication, err)
+	}()
+
 	//Default client
 	config := DefaultConfig()
 	client, err = NewClient(config)
@@ -68,22 +82,22 @@ func (v *Vault) Initialize() error {
 	}
 
 	//Auth to Vault
-	log.Println("Client authenticating to Vault")
+	log.Info("Client authenticating to Vault")
 	switch v.Authentication {
 	case "token":
-		log.Println("Using token authentication")
+		log.Info("Using token authentication")
 		if len(client.Token()) > 0 {
-			log.Println("Got token from VAULT_TOKEN")
+			log.Info("Got token from VAULT_TOKEN")
 			break
 		} else if len(v.Credential.Token) > 0 {
-			log.Println("Got token from config file")
+			log.Info("Got token from config file")
 			token = v.Credential.Token
 		} else {
 			return errors.New("Could not get Vault token.")
 		}
 		client.SetToken(token)
 	case "approle":
-		log.Println("Using approle authentication")
+		log.Info("Using approle authentication")
 
 		//Check Mount
 		if len(v.Credential.RoleID) == 0 {
@@ -102,29 +116,29 @@ func (v *Vault) Initialize() error {
 			return err
 		}
 
-		log.Printf("Metadata: %v", secret.Auth.Metadata)
+		log.WithField("metadata", secret.Auth.Metadata).Info("Authenticated to Vault")
 		token = secret.Auth.ClientToken
 		client.SetToken(token)
 	case "kubernetes":
-		log.Println("Using kubernetes authentication")
+		log.Info("Using kubernetes authentication")
 
 		//Check Mount
 		if len(v.Mount) == 0 {
 			return errors.New("Auth mount not in config.")
 		}
-		log.Printf("Mount: auth/%s", v.Mount)
+		log.WithField("mount", fmt.Sprintf("auth/%s", v.Mount)).Info("Using auth mount")
 
 		//Check Role
 		if len(v.Role) == 0 {
 			return errors.New("K8s role not in config.")
 		}
-		log.Printf("Role: %s", v.Role)
+		log.WithField("role", v.Role).Info("Using auth role")
 
 		//Check SA
 		if len(v.Credential.ServiceAccount) == 0 {
 			return errors.New("K8s SA file not in config.")
 		}
-		log.Printf("SA: %s", v.Credential.ServiceAccount)
+		log.WithField("service_account", v.Credential.ServiceAccount).Info("Using service account")
 
 		//Get the JWT from POD
 		jwt, err := ioutil.ReadFile(v.Credential.ServiceAccount)
@@ -140,25 +154,25 @@ func (v *Vault) Initialize() error {
 		}
 
 		//Set client token
-		log.Printf("Metadata: %v", secret.Auth.Metadata)
+		log.WithField("metadata", secret.Auth.Metadata).Info("Authenticated to Vault")
 		token = secret.Auth.ClientToken
 		client.SetToken(token)
 	case "aws-iam":
 		var svc *sts.STS
 
-		log.Println("Using AWS IAM authentication")
+		log.Info("Using AWS IAM authentication")
 
 		//Check Mount
 		if len(v.Mount) == 0 {
 			return errors.New("Auth mount not in config.")
 		}
-		log.Printf("Mount: auth/%s", v.Mount)
+		log.WithField("mount", fmt.Sprintf("auth/%s", v.Mount)).Info("Using auth mount")
 
 		//Check Role
 		if len(v.Role) == 0 {
 			return errors.New("AWS role not in config.")
 		}
-		log.Printf("Role: %s", v.Role)
+		log.WithField("role", v.Role).Info("Using auth role")
 
 		//Get a session
 		loginData := make(map[string]interface{})
@@ -167,11 +181,11 @@ func (v *Vault) Initialize() error {
 		//If we have a creds/sa var we will try to assume it.
 		//If not we will create an STS session with our default creds.
 		if len(v.Credential.ServiceAccount) > 0 {
-			log.Printf("SA: %s", v.Credential.ServiceAccount)
+			log.WithField("service_account", v.Credential.ServiceAccount).Info("Using service account")
 			creds := stscreds.NewCredentials(stsSession, v.Credential.ServiceAccount)
 			svc = sts.New(stsSession, &aws.Config{Credentials: creds})
 		} else {
-			log.Printf("SA: Using IAM instance profile")
+			log.Info("Using IAM instance profile")
 			svc = sts.New(stsSession)
 		}
 
@@ -210,17 +224,17 @@ func (v *Vault) Initialize() error {
 		}
 
 		//Set client token
-		log.Printf("Metadata: %v", secret.Auth.Metadata)
+		log.WithField("metadata", secret.Auth.Metadata).Info("Authenticated to Vault")
 		token = secret.Auth.ClientToken
 		client.SetToken(token)
 	case "aws-ec2":
-		log.Println("Using AWS EC2 authentication")
+		log.Info("Using AWS EC2 authentication")
 
 		//Check Mount
 		if len(v.Mount) == 0 {
 			return errors.New("Auth mount not in config.")
 		}
-		log.Printf("Mount: auth/%s", v.Mount)
+		log.WithField("mount", fmt.Sprintf("auth/%s", v.Mount)).Info("Using auth mount")
 
 		//Check the metadata service is available
 		ec2Session := session.Must(session.NewSession())
@@ -246,29 +260,29 @@ func (v *Vault) Initialize() error {
 		}
 
 		//Set client token
-		log.Printf("Metadata: %v", secret.Auth.Metadata)
+		log.WithField("metadata", secret.Auth.Metadata).Info("Authenticated to Vault")
 		token = secret.Auth.ClientToken
 		client.SetToken(token)
 	case "gcp-iam":
-		log.Println("Using GCP IAM authentication")
+		log.Info("Using GCP IAM authentication")
 
 		//Check Mount
 		if len(v.Mount) == 0 {
 			return errors.New("Auth mount not in config.")
 		}
-		log.Printf("Mount: auth/%s", v.Mount)
+		log.WithField("mount", fmt.Sprintf("auth/%s", v.Mount)).Info("Using auth mount")
 
 		//Check Role
 		if len(v.Role) == 0 {
 			return errors.New("GCP role not in config.")
 		}
-		log.Printf("Role: %s", v.Role)
+		log.WithField("role", v.Role).Info("Using auth role")
 
 		//Check SA
 		if len(v.Credential.ServiceAccount) == 0 {
 			return errors.New("GCP SA not in config.")
 		}
-		log.Printf("SA: %s", v.Credential)
+		log.WithField("service_account", v.Credential.ServiceAccount).Info("Using service account")
 
 		//Set up client
 		ctx := context.Background()
@@ -313,19 +327,19 @@ func (v *Vault) Initialize() error {
 		}
 
 		//Set client token
-		log.Printf("Metadata: %v", secret.Auth.Metadata)
+		log.WithField("metadata", secret.Auth.Metadata).Info("Authenticated to Vault")
 		token = secret.Auth.ClientToken
 		client.SetToken(token)
 	case "gcp-gce":
 		var metaUrl string
 
-		log.Println("Using GCP GCE authentication")
+		log.Info("Using GCP GCE authentication")
 
 		//Check Mount
 		if len(v.Mount) == 0 {
 			return errors.New("Auth mount not in config.")
 		}
-		log.Printf("Mount: auth/%s", v.Mount)
+		log.WithField("mount", fmt.Sprintf("auth/%s", v.Mount)).Info("Using auth mount")
 
 		//Check metadata service is available
 		if !metadata.OnGCE() {
@@ -376,29 +390,29 @@ func (v *Vault) Initialize() error {
 		}
 
 		//Set client token
-		log.Printf("Metadata: %v", secret.Auth.Metadata)
+		log.WithField("metadata", secret.Auth.Metadata).Info("Authenticated to Vault")
 		token = secret.Auth.ClientToken
 		client.SetToken(token)
 	case "azure-msi":
-		log.Println("Using AZURE MSI authentication")
+		log.Info("Using AZURE MSI authentication")
 
 		//Check Mount
 		if len(v.Mount) == 0 {
 			return errors.New("Auth mount not in config.")
 		}
-		log.Printf("Mount: auth/%s", v.Mount)
+		log.WithField("mount", fmt.Sprintf("auth/%s", v.Mount)).Info("Using auth mount")
 
 		//Check Role
 		if len(v.Role) == 0 {
 			return errors.New("Azure role not in config.")
 		}
-		log.Printf("Role: %s", v.Role)
+		log.WithField("role", v.Role).Info("Using auth role")
 
 		//Check resource
 		if len(v.Credential.ServiceAccount) == 0 {
 			return errors.New("Azure resource not in config.")
 		}
-		log.Printf("Credential: %s", v.Credential)
+		log.WithField("resource", v.Credential.ServiceAccount).Info("Using Azure resource")
 
 		// Create HTTP request for MSI token to access Azure Resource Manager
 		var msiEndpoint *url.URL
@@ -454,7 +468,7 @@ func (v *Vault) Initialize() error {
 		}
 
 		//Set client token
-		log.Printf("Metadata: %v", secret.Auth.Metadata)
+		log.WithField("metadata", secret.Auth.Metadata).Info("Authenticated to Vault")
 		token = secret.Auth.ClientToken
 		client.SetToken(token)
 	default:
@@ -462,13 +476,17 @@ func (v *Vault) Initialize() error {
 	}
 
 	//See if the token we got is renewable
-	log.Println("Looking up token")
+	log.Info("Looking up token")
 	lookup, err := client.Auth().Token().LookupSelf()
 	//If token is not valid so get out of here early
 	if err != nil {
 		return err
 	}
 
+	if ttl, err := lookup.TokenTTL(); err == nil {
+		metrics.SetTokenTTL(int(ttl.Seconds()))
+	}
+
 	//Check renewable
 	renew = lookup.Data["renewable"].(bool)
 	if renew == true {
@@ -479,11 +497,14 @@ func (v *Vault) Initialize() error {
 }
 
 func (v *Vault) GetSecret(path string) (Secret, error) {
-	log.Printf("Getting secret: %s", path)
+	log.WithField("path", path).Info("Getting secret")
 	secret, err := client.Logical().Read(path)
 	if err != nil {
 		return Secret{}, err
 	}
+	if len(secret.LeaseID) > 0 {
+		trackLease(secret.LeaseID, secret.LeaseDuration)
+	}
 	return *secret, nil
 }
 
@@ -507,7 +528,7 @@ func (v *Vault) RenewToken() {
 	}
 
 	//Start the renewer
-	log.Printf("Starting token lifecycle management for accessor: %s", secret.Auth.Accessor)
+	log.WithField("accessor", secret.Auth.Accessor).Info("Starting token lifecycle management")
 	go renewer.Renew()
 	defer renewer.Stop()
 
@@ -515,13 +536,16 @@ func (v *Vault) RenewToken() {
 	for {
 		select {
 		case err := <-renewer.DoneCh():
+			metrics.Renewal("token", errors.New("Token renewal stopped."))
 			if err != nil {
 				log.Fatal(err)
 			}
 			//App will terminate after token cannot be renewed.
-			log.Fatalf("Cannot renew token with accessor %s. App will terminate.", secret.Auth.Accessor)
+			log.WithField("accessor", secret.Auth.Accessor).Fatal("Cannot renew token. App will terminate.")
 		case renewal := <-renewer.RenewCh():
-			log.Printf("Successfully renewed token accessor: %s", renewal.Secret.Auth.Accessor)
+			metrics.Renewal("token", nil)
+			metrics.SetTokenTTL(renewal.Secret.Auth.LeaseDuration)
+			log.WithField("accessor", renewal.Secret.Auth.Accessor).Info("Successfully renewed token")
 		}
 	}
 }
@@ -538,7 +562,7 @@ func (v *Vault) RenewSecret(secret Secret) error {
 	}
 
 	//Start the renewer
-	log.Printf("Starting secret lifecycle management for lease: %s", secret.LeaseID)
+	log.WithField("lease", secret.LeaseID).Info("Starting secret lifecycle management")
 	go renewer.Renew()
 	defer renewer.Stop()
 
@@ -546,22 +570,55 @@ func (v *Vault) RenewSecret(secret Secret) error {
 	for {
 		select {
 		case err := <-renewer.DoneCh():
+			metrics.Renewal("lease", errors.New("Lease renewal stopped."))
 			if err != nil {
 				log.Fatal(err)
 			}
 			//Renewal is now past max TTL. Let app die reschedule it elsewhere. TODO: Allow for getting new creds here.
-			log.Fatalf("Cannot renew %s. App will terminate.", secret.LeaseID)
+			log.WithField("lease", secret.LeaseID).Fatal("Cannot renew secret lease. App will terminate.")
 		case renewal := <-renewer.RenewCh():
-			log.Printf("Successfully renewed secret lease: %s", renewal.Secret.LeaseID)
+			metrics.Renewal("lease", nil)
+			trackLease(renewal.Secret.LeaseID, renewal.Secret.LeaseDuration)
+			log.WithField("lease", renewal.Secret.LeaseID).Info("Successfully renewed secret lease")
 		}
 	}
 }
 
-func (v *Vault) Encrypt(path string, plaintext string) (string, error) {
+// LookupToken looks up another caller's token with auth/token/lookup
+func (v *Vault) LookupToken(ctx context.Context, token string) (*Secret, error) {
+	_, span := tracing.Start(ctx, "vault.LookupToken")
+	defer span.End()
+
+	secret, err := client.Auth().Token().Lookup(token)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+	if secret == nil {
+		return nil, errors.New("Empty response from token lookup.")
+	}
+	return secret, nil
+}
+
+// ReadEntity reads a caller's identity entity by id
+func (v *Vault) ReadEntity(ctx context.Context, id string) (*Secret, error) {
+	_, span := tracing.Start(ctx, "vault.ReadEntity")
+	defer span.End()
+
+	secret, err := client.Logical().Read("identity/entity/id/" + id)
+	if err != nil {
+		return nil, tracing.Error(span, err)
+	}
+	if secret == nil {
+		return nil, errors.New("Entity not found.")
+	}
+	return secret, nil
+}
+
+func (v *Vault) Encrypt(ctx context.Context, path string, plaintext string) (string, error) {
 	var ciphertext string
 
 	data := map[string]interface{}{"plaintext": plaintext}
-	secret, err := client.Logical().Write(path, data)
+	secret, err := transitWrite(ctx, path, data)
 	if err != nil {
 		return "", err
 	}
@@ -570,11 +627,11 @@ func (v *Vault) Encrypt(path string, plaintext string) (string, error) {
 	return ciphertext, nil
 }
 
-func (v *Vault) Decrypt(path string, ciphertext string) (string, error) {
+func (v *Vault) Decrypt(ctx context.Context, path string, ciphertext string) (string, error) {
 	var plaintext string
 
 	data := map[string]interface{}{"ciphertext": ciphertext}
-	secret, err := client.Logical().Write(path, data)
+	secret, err := transitWrite(ctx, path, data)
 	if err != nil {
 		return "", err
 	}
@@ -583,6 +640,227 @@ func (v *Vault) Decrypt(path string, ciphertext string) (string, error) {
 	return plaintext, nil
 }
 
+// Contexts are optional and only used with derived keys
+func (v *Vault) EncryptBatch(ctx context.Context, path string, plaintexts []string, contexts []string) ([]string, []error, error) {
+	var batch []map[string]interface{}
+
+	for i, plaintext := range plaintexts {
+		batch = append(batch, withContext(map[string]interface{}{"plaintext": plaintext}, contexts, i))
+	}
+
+	return writeBatch(ctx, path, batch, "ciphertext")
+}
+
+func (v *Vault) DecryptBatch(ctx context.Context, path string, ciphertexts []string, contexts []string) ([]string, []error, error) {
+	var batch []map[string]interface{}
+
+	for i, ciphertext := range ciphertexts {
+		batch = append(batch, withContext(map[string]interface{}{"ciphertext": ciphertext}, contexts, i))
+	}
+
+	return writeBatch(ctx, path, batch, "plaintext")
+}
+
+func (v *Vault) DataKey(ctx context.Context, path string, derivation string) (string, string, error) {
+	data := map[string]interface{}{}
+	if len(derivation) > 0 {
+		data["context"] = base64.StdEncoding.EncodeToString([]byte(derivation))
+	}
+
+	secret, err := transitWrite(ctx, path, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	plaintext := secret.Data["plaintext"].(string)
+	ciphertext := secret.Data["ciphertext"].(string)
+	return plaintext, ciphertext, nil
+}
+
+func (v *Vault) HMAC(ctx context.Context, path string, input string) (string, error) {
+	var hmac string
+
+	data := map[string]interface{}{"input": input}
+	secret, err := transitWrite(ctx, path, data)
+	if err != nil {
+		return "", err
+	}
+
+	hmac = secret.Data["hmac"].(string)
+	return hmac, nil
+}
+
+// HMACBatch computes the HMAC of each input in one call
+func (v *Vault) HMACBatch(ctx context.Context, path string, inputs []string) ([]string, []error, error) {
+	var batch []map[string]interface{}
+
+	for _, input := range inputs {
+		batch = append(batch, map[string]interface{}{"input": input})
+	}
+
+	return writeBatch(ctx, path, batch, "hmac")
+}
+
 func (v *Vault) Close() {
 	client.Auth().Token().RevokeSelf(client.Token())
 }
+
+func (v *Vault) Sign(ctx context.Context, path string, input string) (string, error) {
+	var signature string
+
+	data := map[string]interface{}{"input": input}
+	secret, err := transitWrite(ctx, path, data)
+	if err != nil {
+		return "", err
+	}
+
+	signature = secret.Data["signature"].(string)
+	return signature, nil
+}
+
+// SignBatch signs each input in one call
+func (v *Vault) SignBatch(ctx context.Context, path string, inputs []string) ([]string, []error, error) {
+	var batch []map[string]interface{}
+
+	for _, input := range inputs {
+		batch = append(batch, map[string]interface{}{"input": input})
+	}
+
+	return writeBatch(ctx, path, batch, "signature")
+}
+
+// VerifyBatch checks signatures in one call. An item transit rejects
+// outright, like a malformed signature, is reported as invalid.
+func (v *Vault) VerifyBatch(ctx context.Context, path string, inputs []string, signatures []string) ([]bool, error) {
+	return verifyBatch(ctx, path, inputs, signatures, "signature")
+}
+
+// VerifyHMACBatch checks HMACs in one call, across key versions
+func (v *Vault) VerifyHMACBatch(ctx context.Context, path string, inputs []string, hmacs []string) ([]bool, error) {
+	return verifyBatch(ctx, path, inputs, hmacs, "hmac")
+}
+
+func verifyBatch(ctx context.Context, path string, inputs []string, values []string, field string) ([]bool, error) {
+	var batch []map[string]interface{}
+	valid := make([]bool, len(inputs))
+
+	if len(inputs) == 0 {
+		return valid, nil
+	}
+	for i, input := range inputs {
+		batch = append(batch, map[string]interface{}{"input": input, field: values[i]})
+	}
+
+	items, err := transitBatch(ctx, path, batch)
+	if err == errBatchRejected {
+		return valid, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, item := range items {
+		result, _ := item.(map[string]interface{})
+		valid[i], _ = result["valid"].(bool)
+	}
+
+	return valid, nil
+}
+
+// Time and trace every transit call by operation, the path segment after the mount
+func transitWrite(ctx context.Context, path string, data map[string]interface{}) (*Secret, error) {
+	operation := "unknown"
+	if parts := strings.Split(path, "/"); len(parts) > 2 {
+		operation = parts[1]
+	}
+
+	_, span := tracing.Start(ctx, "vault.transit."+operation, attribute.String("vault.path", path))
+	defer span.End()
+
+	start := time.Now()
+	secret, err := client.Logical().Write(path, data)
+	metrics.ObserveTransit(operation, start, err)
+
+	return secret, tracing.Error(span, err)
+}
+
+// Drop the lease id so the metric is labelled by secret path
+func leasePath(leaseID string) string {
+	if i := strings.LastIndex(leaseID, "/"); i > 0 {
+		return leaseID[:i]
+	}
+	return leaseID
+}
+
+func withContext(item map[string]interface{}, contexts []string, i int) map[string]interface{} {
+	if i < len(contexts) && len(contexts[i]) > 0 {
+		item["context"] = base64.StdEncoding.EncodeToString([]byte(contexts[i]))
+	}
+	return item
+}
+
+// Transit returns batch results in input order with a per item error
+func writeBatch(ctx context.Context, path string, batch []map[string]interface{}, field string) ([]string, []error, error) {
+	results := make([]string, len(batch))
+	errs := make([]error, len(batch))
+
+	if len(batch) == 0 {
+		return results, errs, nil
+	}
+
+	items, err := transitBatch(ctx, path, batch)
+	if err == errBatchRejected {
+		for i := range errs {
+			errs[i] = err
+		}
+		return results, errs, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, item := range items {
+		result, _ := item.(map[string]interface{})
+		if msg, ok := result["error"].(string); ok && len(msg) > 0 {
+			errs[i] = errors.New(msg)
+			continue
+		}
+		value, ok := result[field].(string)
+		if !ok {
+			errs[i] = fmt.Errorf("Transit batch result missing %s", field)
+			continue
+		}
+		results[i] = value
+	}
+
+	return results, errs, nil
+}
+
+// Send a batch and hand back its results. Transit answers a batch where some
+// items failed with a 400 unless asked for another status, and still answers
+// 400 when every item failed, with the results but no request level errors.
+// That case comes back as errBatchRejected so callers fail each item instead
+// of the whole call.
+func transitBatch(ctx context.Context, path string, batch []map[string]interface{}) ([]interface{}, error) {
+	data := map[string]interface{}{
+		"batch_input":                   batch,
+		"partial_failure_response_code": http.StatusMultiStatus,
+	}
+
+	secret, err := transitWrite(ctx, path, data)
+	var respErr *ResponseError
+	if errors.As(err, &respErr) && respErr.StatusCode == http.StatusBadRequest && len(respErr.Errors) == 0 {
+		return nil, errBatchRejected
+	}
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("Empty response from transit batch.")
+	}
+
+	items, ok := secret.Data["batch_results"].([]interface{})
+	if !ok || len(items) != len(batch) {
+		return nil, fmt.Errorf("Expected %d transit batch results, got %d", len(batch), len(items))
+	}
+	return items, nil
+}
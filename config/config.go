@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"time"
 	//"strings"
 
 	"github.com/spf13/viper"
@@ -9,8 +10,57 @@ import (
 
 type Config struct {
 	Server struct {
-		Port string `toml:"port"`
+		Port    string `toml:"port"`
+		MaxBody int64  `mapstructure:"max-body"`
+		TLS     struct {
+			Enabled    bool   `toml:"enabled"`
+			CertFile   string `mapstructure:"cert-file"`
+			KeyFile    string `mapstructure:"key-file"`
+			ClientAuth string `mapstructure:"client-auth"`
+			ClientCA   string `mapstructure:"client-ca"`
+			PKI        struct {
+				Mount      string        `toml:"mount"`
+				Role       string        `toml:"role"`
+				CommonName string        `mapstructure:"common-name"`
+				AltNames   []string      `mapstructure:"alt-names"`
+				TTL        time.Duration `toml:"ttl"`
+			} `toml:"pki"`
+		} `toml:"tls"`
 	} `toml:"server"`
+	Catalog struct {
+		Products []string `toml:"products"`
+	} `toml:"catalog"`
+	Bulk struct {
+		MaxBody int64 `mapstructure:"max-body"`
+	} `toml:"bulk"`
+	Events struct {
+		KeepAlive time.Duration `mapstructure:"keep-alive"`
+		Retention time.Duration `toml:"retention"`
+	} `toml:"events"`
+	Webhooks struct {
+		Key         string        `toml:"key"`
+		Poll        time.Duration `toml:"poll"`
+		Timeout     time.Duration `toml:"timeout"`
+		MaxAttempts int           `mapstructure:"max-attempts"`
+		Backoff     time.Duration `toml:"backoff"`
+		MaxBackoff  time.Duration `mapstructure:"max-backoff"`
+	} `toml:"webhooks"`
+	Retention struct {
+		Deleted  time.Duration `toml:"deleted"`
+		Mode     string        `toml:"mode"`
+		Interval time.Duration `toml:"interval"`
+	} `toml:"retention"`
+	Idempotency struct {
+		TTL time.Duration `toml:"ttl"`
+	} `toml:"idempotency"`
+	Health struct {
+		Interval time.Duration `toml:"interval"`
+	} `toml:"health"`
+	GRPC struct {
+		Enabled    bool   `toml:"enabled"`
+		Port       string `toml:"port"`
+		Reflection bool   `toml:"reflection"`
+	} `toml:"grpc"`
 	Database struct {
 		Host     string `toml:"host"`
 		Port     string `toml:"port"`
@@ -36,10 +86,58 @@ type Config struct {
 			Role  string `toml:"role"`
 		} `toml:"database"`
 		Transit struct {
-			Key   string `toml:"key"`
-			Mount string `toml:"mount"`
+			Key         string        `toml:"key"`
+			LegacyKey   string        `mapstructure:"legacy-key"`
+			Mount       string        `toml:"mount"`
+			Mode        string        `toml:"mode"`
+			DataKeyTTL  time.Duration `mapstructure:"datakey-ttl"`
+			DataKeyUses int           `mapstructure:"datakey-uses"`
+			SigningKey  string        `mapstructure:"signing-key"`
+			Integrity   string        `toml:"integrity"`
 		} `toml:"transit"`
 	} `toml:"vault"`
+	Auth struct {
+		Methods []string `toml:"methods"`
+		Vault   struct {
+			CacheTTL time.Duration `mapstructure:"cache-ttl"`
+		} `toml:"vault"`
+		JWT struct {
+			JWKS       string        `toml:"jwks"`
+			Issuer     string        `toml:"issuer"`
+			Audience   string        `toml:"audience"`
+			RolesClaim string        `mapstructure:"roles-claim"`
+			Refresh    time.Duration `toml:"refresh"`
+		} `toml:"jwt"`
+	} `toml:"auth"`
+	Authz struct {
+		MetadataKey string              `mapstructure:"metadata-key"`
+		Roles       map[string][]string `toml:"roles"`
+		Users       []struct {
+			Method string   `toml:"method"`
+			Name   string   `toml:"name"`
+			Roles  []string `toml:"roles"`
+		} `toml:"users"`
+	} `toml:"authz"`
+	Masking struct {
+		Default string            `toml:"default"`
+		Routes  map[string]string `toml:"routes"`
+		Roles   map[string]string `toml:"roles"`
+	} `toml:"masking"`
+	Audit struct {
+		Sink string `toml:"sink"`
+		Path string `toml:"path"`
+		Key  string `toml:"key"`
+	} `toml:"audit"`
+	Log struct {
+		Level  string `toml:"level"`
+		Format string `toml:"format"`
+	} `toml:"log"`
+	Tracing struct {
+		Exporter string  `toml:"exporter"`
+		Endpoint string  `toml:"endpoint"`
+		Insecure bool    `toml:"insecure"`
+		Ratio    float64 `toml:"ratio"`
+	} `toml:"tracing"`
 }
 
 func (c *Config) Read() {
@@ -50,11 +148,54 @@ func (c *Config) Read() {
 	//viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	//Server Defaults
 	viper.SetDefault("Server.Port", "8080")
+	viper.SetDefault("Server.max-body", 1<<20)
+	viper.SetDefault("Server.TLS.client-auth", "none")
+	viper.SetDefault("Server.TLS.PKI.Mount", "pki")
+	viper.SetDefault("Server.TLS.PKI.TTL", "72h")
+	viper.SetDefault("Bulk.max-body", 64<<20)
+	viper.SetDefault("Idempotency.TTL", "24h")
+	viper.SetDefault("Retention.Deleted", "720h")
+	viper.SetDefault("Retention.Mode", "delete")
+	viper.SetDefault("Retention.Interval", "1h")
+	viper.SetDefault("Events.keep-alive", "15s")
+	viper.SetDefault("Events.Retention", "24h")
+	viper.SetDefault("Webhooks.Key", "webhook")
+	viper.SetDefault("Webhooks.Poll", "5s")
+	viper.SetDefault("Webhooks.Timeout", "10s")
+	viper.SetDefault("Webhooks.max-attempts", 10)
+	viper.SetDefault("Webhooks.Backoff", "30s")
+	viper.SetDefault("Webhooks.max-backoff", "1h")
+	viper.SetDefault("Health.Interval", "10s")
+	viper.SetDefault("GRPC.Port", "9090")
+	viper.SetDefault("GRPC.Reflection", false)
 	//Vault Defaults
 	viper.SetDefault("Vault.Host", "127.0.0.1")
 	viper.SetDefault("Vault.Port", "8200")
 	viper.SetDefault("Vault.Scheme", "http")
 	viper.SetDefault("Vault.Authentication", "token")
+	viper.SetDefault("Vault.Transit.Mode", "transit")
+	viper.SetDefault("Vault.Transit.datakey-ttl", "5m")
+	viper.SetDefault("Vault.Transit.datakey-uses", 1000)
+	viper.SetDefault("Vault.Transit.signing-key", "order-signing")
+	viper.SetDefault("Vault.Transit.Integrity", "flag")
+	//Auth Defaults
+	viper.SetDefault("Auth.Vault.cache-ttl", "1m")
+	viper.SetDefault("Auth.JWT.roles-claim", "roles")
+	viper.SetDefault("Auth.JWT.Refresh", "15m")
+	viper.SetDefault("Authz.metadata-key", "app_roles")
+	viper.SetDefault("Authz.Roles", map[string][]string{"admin": {"read-masked", "read-pii", "create", "update", "delete", "admin"}})
+	viper.SetDefault("Masking.Default", "mask")
+	//Audit Defaults
+	viper.SetDefault("Audit.Sink", "postgres")
+	viper.SetDefault("Audit.Path", "audit.log")
+	viper.SetDefault("Audit.Key", "audit")
+	//Log Defaults
+	viper.SetDefault("Log.Level", "info")
+	viper.SetDefault("Log.Format", "text")
+	//Tracing Defaults
+	viper.SetDefault("Tracing.Exporter", "none")
+	viper.SetDefault("Tracing.Endpoint", "localhost:4317")
+	viper.SetDefault("Tracing.Ratio", 1.0)
 	//DB Defaults
 	viper.SetDefault("Database.Host", "localhost")
 	viper.SetDefault("Database.Port", "5432")
@@ -0,0 +1,63 @@
+package dao
+
+import (
+	"context"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+// Audit keeps the audit chain in Postgres
+type Audit struct{}
+
+func (d *Audit) Append(ctx context.Context, entries []models.AuditEntry) error {
+	conn, span := startSpan(ctx, "dao.Audit.Append")
+	defer span.End()
+
+	//One statement, and the seq primary key stops two writers extending
+	//the same entry
+	return mapError(tracing.Error(span, conn.Insert(&entries)))
+}
+
+func (d *Audit) Last(ctx context.Context) (*models.AuditEntry, error) {
+	var entry models.AuditEntry
+
+	conn, span := startSpan(ctx, "dao.Audit.Last")
+	defer span.End()
+
+	err := conn.Model(&entry).Order("seq DESC").Limit(1).Select()
+	if err == pg.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, mapError(tracing.Error(span, err))
+	}
+
+	return &entry, nil
+}
+
+func (d *Audit) Each(ctx context.Context, fn func(models.AuditEntry) error) error {
+	var last int64
+
+	conn, span := startSpan(ctx, "dao.Audit.Each")
+	defer span.End()
+
+	//Page through so we don't hold the whole log
+	for {
+		var entries []models.AuditEntry
+		err := conn.Model(&entries).Where("seq > ?", last).Order("seq ASC").Limit(500).Select()
+		if err != nil {
+			return mapError(tracing.Error(span, err))
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		last = entries[len(entries)-1].Seq
+	}
+}
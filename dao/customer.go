@@ -0,0 +1,128 @@
+package dao
+
+import (
+	"context"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+type Customer struct{}
+
+// NextId reserves an id so the customer can be audited before it is inserted
+func (d *Customer) NextId(ctx context.Context) (int64, error) {
+	var id int64
+
+	conn, span := startSpan(ctx, "dao.Customer.NextId")
+	defer span.End()
+
+	_, err := conn.QueryOne(pg.Scan(&id), "SELECT nextval('customers_id_seq')")
+	return id, mapError(tracing.Error(span, err))
+}
+
+func (d *Customer) FindAll(ctx context.Context) ([]models.Customer, error) {
+	var customers []models.Customer
+
+	conn, span := startSpan(ctx, "dao.Customer.FindAll")
+	defer span.End()
+
+	err := conn.Model(&customers).Order("id ASC").Select()
+	if err != nil {
+		return []models.Customer{}, mapError(tracing.Error(span, err))
+	}
+
+	return customers, nil
+}
+
+func (d *Customer) FindById(ctx context.Context, id int64) (models.Customer, error) {
+	customer := models.Customer{Id: id}
+
+	conn, span := startSpan(ctx, "dao.Customer.FindById")
+	defer span.End()
+
+	err := conn.Select(&customer)
+	if err == pg.ErrNoRows {
+		return customer, ErrCustomerNotFound
+	}
+	return customer, mapError(tracing.Error(span, err))
+}
+
+func (d *Customer) FindByIds(ctx context.Context, ids []int64) ([]models.Customer, error) {
+	var customers []models.Customer
+
+	if len(ids) == 0 {
+		return customers, nil
+	}
+
+	conn, span := startSpan(ctx, "dao.Customer.FindByIds")
+	defer span.End()
+
+	err := conn.Model(&customers).Where("id IN (?)", pg.In(ids)).Select()
+	if err != nil {
+		return []models.Customer{}, mapError(tracing.Error(span, err))
+	}
+
+	return customers, nil
+}
+
+// Insert fails with ErrConflict if another customer has the same email
+func (d *Customer) Insert(ctx context.Context, customer models.Customer) (models.Customer, error) {
+	conn, span := startSpan(ctx, "dao.Customer.Insert")
+	defer span.End()
+
+	err := conn.Insert(&customer)
+	if err != nil {
+		return customer, mapError(tracing.Error(span, err))
+	}
+
+	return customer, nil
+}
+
+// Update rewrites a customer along with the index, mask and signature of
+// the orders that reference it, in one transaction
+func (d *Customer) Update(ctx context.Context, customer models.Customer, orders []models.Order) error {
+	conn, span := startSpan(ctx, "dao.Customer.Update")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(&customer).WherePK().Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return ErrCustomerNotFound
+		}
+
+		for i := range orders {
+			_, err := tx.Model(&orders[i]).
+				Column("customer_index", "customer_mask", "signature").
+				WherePK().
+				Where("customer_id = ?", customer.Id).
+				Update()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return mapError(tracing.Error(span, err))
+}
+
+// Delete fails with ErrCustomerInUse while orders still reference the customer
+func (d *Customer) Delete(ctx context.Context, id int64) error {
+	conn, span := startSpan(ctx, "dao.Customer.Delete")
+	defer span.End()
+
+	res, err := conn.Model(&models.Customer{}).Where("id = ?", id).Delete()
+	if err != nil {
+		if pgErr, ok := err.(pg.Error); ok && pgErr.Field('C') == "23503" {
+			return ErrCustomerInUse
+		}
+		return mapError(tracing.Error(span, err))
+	}
+	if res.RowsAffected() == 0 {
+		return ErrCustomerNotFound
+	}
+	return nil
+}
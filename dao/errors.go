@@ -0,0 +1,62 @@
+package dao
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/go-pg/pg"
+)
+
+var (
+	// ErrNotFound is returned when no order has the requested id
+	ErrNotFound = errors.New("Order not found.")
+	// ErrConflict is returned when a write collides with an existing row
+	ErrConflict = errors.New("Order conflicts with an existing order.")
+	// ErrInvalid is returned when Postgres rejects the values in a write
+	ErrInvalid = errors.New("Order was rejected by the database.")
+	// ErrUnavailable is returned when Postgres can't be reached in time
+	ErrUnavailable = errors.New("Database is unavailable.")
+	// ErrCustomerNotFound is returned when no customer has the requested id
+	ErrCustomerNotFound = errors.New("Customer not found.")
+	// ErrCustomerInUse is returned when deleting a customer that orders still reference
+	ErrCustomerInUse = errors.New("Customer still has orders.")
+	// ErrWebhookNotFound is returned when no webhook has the requested id
+	ErrWebhookNotFound = errors.New("Webhook not found.")
+	// ErrDeadLetterNotFound is returned when no dead letter has the requested id
+	ErrDeadLetterNotFound = errors.New("Dead letter not found.")
+)
+
+// Turn driver errors callers can act on into our own. Anything else is
+// passed through as is.
+func mapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == pg.ErrNoRows {
+		return ErrNotFound
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return ErrUnavailable
+	}
+	if _, ok := err.(net.Error); ok {
+		return ErrUnavailable
+	}
+
+	pgErr, ok := err.(pg.Error)
+	if !ok {
+		return err
+	}
+	//SQLSTATE classes, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+	code := pgErr.Field('C')
+	switch {
+	case code == "23505", code == "23503":
+		return ErrConflict
+	case code == "23502", code == "23514", strings.HasPrefix(code, "22"):
+		return ErrInvalid
+	case strings.HasPrefix(code, "08"), strings.HasPrefix(code, "53"), strings.HasPrefix(code, "57"):
+		return ErrUnavailable
+	}
+	return err
+}
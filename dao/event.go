@@ -0,0 +1,169 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event reads the order change feed the orders trigger writes
+type Event struct{}
+
+// Channel the orders trigger and the sequencer notify
+const eventChannel = "order_events"
+
+// Advisory lock held while positioning events, so only one sequencer runs
+// at a time across instances
+const sequencerLock = 0x6f726465
+
+// Most events positioned at a time
+const sequenceBatch = 1000
+
+// Sequence gives committed events their position in the feed. Ids are taken
+// before the change commits, so a later id can commit first. Positions are
+// only handed out to events that have committed, one sequencer at a time,
+// so nothing can be positioned behind a reader's cursor and a long running
+// transaction only holds back its own events. Listeners are notified when
+// anything was positioned.
+func (d *Event) Sequence(ctx context.Context) (int, error) {
+	var positioned int
+
+	conn, span := startSpan(ctx, "dao.Event.Sequence")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", sequencerLock); err != nil {
+			return err
+		}
+		res, err := tx.Exec(`
+			UPDATE order_events SET position = nextval('order_events_position_seq')
+			WHERE id IN (
+				SELECT id FROM order_events
+				WHERE position IS NULL
+				ORDER BY id ASC
+				LIMIT ?
+				FOR UPDATE SKIP LOCKED)`,
+			sequenceBatch)
+		if err != nil {
+			return err
+		}
+		positioned = res.RowsAffected()
+		if positioned > 0 {
+			_, err = tx.Exec("SELECT pg_notify(?, '')", eventChannel)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, mapError(tracing.Error(span, err))
+	}
+
+	return positioned, nil
+}
+
+// Now is the position past every event positioned so far
+func (d *Event) Now(ctx context.Context) (int64, error) {
+	var position int64
+
+	conn, span := startSpan(ctx, "dao.Event.Now")
+	defer span.End()
+
+	_, err := conn.QueryOne(pg.Scan(&position), "SELECT coalesce(max(position), 0) FROM order_events")
+	if err != nil {
+		return 0, mapError(tracing.Error(span, err))
+	}
+	return position, nil
+}
+
+// PositionAfter is the position just past an event. When the event is gone
+// it backs up to just before the events after it, so some may be read again
+// but none are skipped.
+func (d *Event) PositionAfter(ctx context.Context, id int64) (int64, error) {
+	var position int64
+
+	conn, span := startSpan(ctx, "dao.Event.PositionAfter")
+	defer span.End()
+
+	_, err := conn.QueryOne(pg.Scan(&position), "SELECT coalesce(position, 0) FROM order_events WHERE id = ?", id)
+	if err == nil && position > 0 {
+		return position, nil
+	}
+	if err != nil && err != pg.ErrNoRows {
+		return 0, mapError(tracing.Error(span, err))
+	}
+
+	_, err = conn.QueryOne(pg.Scan(&position), "SELECT coalesce(min(position), 0) FROM order_events WHERE id > ?", id)
+	if err != nil {
+		return 0, mapError(tracing.Error(span, err))
+	}
+	if position == 0 {
+		return d.Now(ctx)
+	}
+	return position - 1, nil
+}
+
+func (d *Event) FindAfter(ctx context.Context, after int64, limit int) ([]models.OrderEvent, error) {
+	var events []models.OrderEvent
+
+	conn, span := startSpan(ctx, "dao.Event.FindAfter")
+	defer span.End()
+
+	err := conn.Model(&events).
+		Where("position > ?", after).
+		Order("position ASC").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return []models.OrderEvent{}, mapError(tracing.Error(span, err))
+	}
+
+	return events, nil
+}
+
+func (d *Event) PurgeBefore(ctx context.Context, before time.Time) (int, error) {
+	conn, span := startSpan(ctx, "dao.Event.PurgeBefore")
+	defer span.End()
+
+	res, err := conn.Model(&models.OrderEvent{}).Where("time < ?", before).Delete()
+	if err != nil {
+		return 0, mapError(tracing.Error(span, err))
+	}
+	return res.RowsAffected(), nil
+}
+
+// Listen holds a connection on the event channel and signals each
+// notification until ctx is done. The listener reconnects on its own, so
+// notifications can be missed and readers should still poll.
+func (d *Event) Listen(ctx context.Context) <-chan struct{} {
+	notified := make(chan struct{}, 1)
+
+	listener := db.Listen(eventChannel)
+	go func() {
+		defer close(notified)
+		defer listener.Close()
+
+		notifications := listener.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification, ok := <-notifications:
+				if !ok {
+					log.WithField("channel", eventChannel).Warn("Order event listener closed")
+					return
+				}
+				log.WithField("event_id", notification.Payload).Debug("Order event notification")
+				//Readers fetch everything past their cursor, so one pending signal is enough
+				select {
+				case notified <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return notified
+}
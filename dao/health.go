@@ -0,0 +1,43 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/dimiro1/health"
+	"github.com/go-pg/pg"
+)
+
+// How long a readiness probe waits on Postgres
+const probeTimeout = 5 * time.Second
+
+// Checker pings Postgres over the live pool, so it follows credential
+// rotation, and reports the pool stats alongside.
+func Checker() health.Checker {
+	return health.CheckerFunc(func() health.Health {
+		var n int
+		h := health.NewHealth()
+
+		if db == nil {
+			h.Down()
+			h.AddInfo("error", "Not connected")
+			return h
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		defer cancel()
+
+		stats := PoolStats()
+		h.AddInfo("connections", stats.TotalConns)
+		h.AddInfo("idle", stats.IdleConns)
+		h.AddInfo("timeouts", stats.Timeouts)
+
+		if _, err := db.WithContext(ctx).QueryOne(pg.Scan(&n), "SELECT 1"); err != nil {
+			h.Down()
+			h.AddInfo("error", err.Error())
+			return h
+		}
+		h.Up()
+		return h
+	})
+}
@@ -0,0 +1,86 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+// Idempotency keeps the idempotency keys for order creation
+type Idempotency struct{}
+
+// Claim records a new key, or takes over one that has expired. It returns
+// false when the key is still held by an earlier request.
+func (d *Idempotency) Claim(ctx context.Context, key models.IdempotencyKey) (bool, error) {
+	var claimed bool
+
+	conn, span := startSpan(ctx, "dao.Idempotency.Claim")
+	defer span.End()
+
+	_, err := conn.QueryOne(pg.Scan(&claimed), `
+		INSERT INTO idempotency_keys (caller, key, fingerprint, order_id, created_at, expires_at)
+		VALUES (?, ?, ?, 0, ?, ?)
+		ON CONFLICT (caller, key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint,
+			order_id = 0,
+			customer_index = NULL,
+			response = NULL,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < EXCLUDED.created_at
+		RETURNING true`,
+		key.Caller, key.Key, key.Fingerprint, key.CreatedAt, key.ExpiresAt)
+	if err == pg.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, mapError(tracing.Error(span, err))
+	}
+
+	return claimed, nil
+}
+
+func (d *Idempotency) Find(ctx context.Context, caller string, key string) (models.IdempotencyKey, error) {
+	idempotencyKey := models.IdempotencyKey{Caller: caller, Key: key}
+
+	conn, span := startSpan(ctx, "dao.Idempotency.Find")
+	defer span.End()
+
+	err := conn.Select(&idempotencyKey)
+	if err == pg.ErrNoRows {
+		return idempotencyKey, ErrNotFound
+	}
+	return idempotencyKey, mapError(tracing.Error(span, err))
+}
+
+// Complete stores the response for a claimed key
+func (d *Idempotency) Complete(ctx context.Context, key models.IdempotencyKey) error {
+	conn, span := startSpan(ctx, "dao.Idempotency.Complete")
+	defer span.End()
+
+	_, err := conn.Model(&key).Column("order_id", "customer_index", "response").WherePK().Update()
+	return mapError(tracing.Error(span, err))
+}
+
+// Release frees a key whose request failed so a retry can run it again
+func (d *Idempotency) Release(ctx context.Context, caller string, key string) error {
+	conn, span := startSpan(ctx, "dao.Idempotency.Release")
+	defer span.End()
+
+	_, err := conn.Model(&models.IdempotencyKey{}).Where("caller = ? AND key = ?", caller, key).Delete()
+	return mapError(tracing.Error(span, err))
+}
+
+func (d *Idempotency) PurgeExpired(ctx context.Context, now time.Time) (int, error) {
+	conn, span := startSpan(ctx, "dao.Idempotency.PurgeExpired")
+	defer span.End()
+
+	res, err := conn.Model(&models.IdempotencyKey{}).Where("expires_at < ?", now).Delete()
+	if err != nil {
+		return 0, mapError(tracing.Error(span, err))
+	}
+	return res.RowsAffected(), nil
+}
@@ -0,0 +1,40 @@
+package dao
+
+import (
+	"strings"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/metrics"
+)
+
+// Times every query by its leading statement keyword
+type queryMetrics struct{}
+
+func (queryMetrics) BeforeQuery(event *pg.QueryEvent) {}
+
+func (queryMetrics) AfterQuery(event *pg.QueryEvent) {
+	statement := "unknown"
+	if query, err := event.FormattedQuery(); err == nil {
+		if fields := strings.Fields(query); len(fields) > 0 {
+			statement = strings.ToUpper(fields[0])
+		}
+	}
+	metrics.ObserveQuery(statement, event.StartTime, event.Error)
+}
+
+// PoolStats reads the connection pool stats of the live connection
+func PoolStats() metrics.PoolStats {
+	if db == nil {
+		return metrics.PoolStats{}
+	}
+
+	stats := db.PoolStats()
+	return metrics.PoolStats{
+		Hits:       stats.Hits,
+		Misses:     stats.Misses,
+		Timeouts:   stats.Timeouts,
+		TotalConns: stats.TotalConns,
+		IdleConns:  stats.IdleConns,
+		StaleConns: stats.StaleConns,
+	}
+}
@@ -1,10 +1,13 @@
 package dao
 
 import (
+	"context"
 	"fmt"
+	"time"
 
 	"github.com/go-pg/pg"
 	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
 )
 
 type Order struct {
@@ -27,6 +30,7 @@ func (d *Order) Connect() error {
 		Addr:     fmt.Sprintf("%s:%s", d.Host, d.Port),
 		Database: d.Database,
 	})
+	db.AddQueryHook(queryMetrics{})
 
 	//Check our connection
 	_, err := db.QueryOne(pg.Scan(&n), "SELECT 1")
@@ -38,44 +42,490 @@ func (d *Order) Close() error {
 	return err
 }
 
-func (d *Order) FindAll() ([]models.Order, error) {
+func (d *Order) FindAll(ctx context.Context) ([]models.Order, error) {
 	var orders []models.Order
 
+	conn, span := startSpan(ctx, "dao.Order.FindAll")
+	defer span.End()
+
 	//Go get the orders
-	err := db.Model(&orders).Select()
+	err := conn.Model(&orders).Where("deleted_at IS NULL").Select()
+	if err == nil {
+		err = attachItems(conn, orders)
+	}
 	if err != nil {
-		return []models.Order{}, err
+		return []models.Order{}, mapError(tracing.Error(span, err))
 	}
 
 	return orders, nil
 }
 
-func (d *Order) DeleteAll() error {
-	var ids []int
+// DeleteAll soft deletes every order and returns their ids
+func (d *Order) DeleteAll(ctx context.Context, now time.Time) ([]int64, error) {
+	var ids []int64
+
+	conn, span := startSpan(ctx, "dao.Order.DeleteAll")
+	defer span.End()
 
-	//Find the order ids
-	err := db.Model(&Order{}).Column("id").Select(&ids)
+	_, err := conn.Model(&models.Order{}).
+		Set("deleted_at = ?", now).
+		Where("deleted_at IS NULL").
+		Returning("id").
+		Update(&ids)
 	if err != nil {
+		return ids, mapError(tracing.Error(span, err))
+	}
+
+	return ids, nil
+}
+
+// NextId reserves an id so the order can be signed before it is inserted
+func (d *Order) NextId(ctx context.Context) (int64, error) {
+	var id int64
+
+	conn, span := startSpan(ctx, "dao.Order.NextId")
+	defer span.End()
+
+	_, err := conn.QueryOne(pg.Scan(&id), "SELECT nextval('orders_id_seq')")
+	return id, mapError(tracing.Error(span, err))
+}
+
+// NextIds reserves ids for a batch of orders
+func (d *Order) NextIds(ctx context.Context, count int) ([]int64, error) {
+	var ids []int64
+
+	conn, span := startSpan(ctx, "dao.Order.NextIds")
+	defer span.End()
+
+	_, err := conn.Query(&ids, "SELECT nextval('orders_id_seq') FROM generate_series(1, ?)", count)
+	return ids, mapError(tracing.Error(span, err))
+}
+
+// Batch writes orders inside a transaction opened by Import
+type Batch struct {
+	tx *pg.Tx
+}
+
+// Import runs fn in one transaction. Everything fn inserts is rolled back
+// if it returns an error.
+func (d *Order) Import(ctx context.Context, fn func(batch *Batch) error) error {
+	conn, span := startSpan(ctx, "dao.Order.Import")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		return fn(&Batch{tx: tx})
+	})
+	return mapError(tracing.Error(span, err))
+}
+
+// Insert writes orders with their items and the transitions that created
+// them. The orders need their ids reserved already.
+func (b *Batch) Insert(orders []models.Order, created []models.OrderTransition) error {
+	var items []models.LineItem
+
+	if len(orders) == 0 {
+		return nil
+	}
+	if _, err := b.tx.Model(&orders).Insert(); err != nil {
 		return err
 	}
 
-	//Delete the order ids if we have results
-	if len(ids) > 0 {
-		pgids := pg.In(ids)
-		_, err := db.Model(&Order{}).Where("id IN (?)", pgids).Delete()
+	for _, order := range orders {
+		for _, item := range order.Items {
+			item.OrderId = order.Id
+			items = append(items, item)
+		}
+	}
+	if len(items) > 0 {
+		if _, err := b.tx.Model(&items).Insert(); err != nil {
+			return err
+		}
+	}
+
+	_, err := b.tx.Model(&created).Insert()
+	return err
+}
+
+func (d *Order) FindAfter(ctx context.Context, after int64, limit int) ([]models.Order, error) {
+	var orders []models.Order
+
+	conn, span := startSpan(ctx, "dao.Order.FindAfter")
+	defer span.End()
+
+	err := conn.Model(&orders).
+		Where("id > ?", after).
+		Where("deleted_at IS NULL").
+		Order("id ASC").
+		Limit(limit).
+		Select()
+	if err == nil {
+		err = attachItems(conn, orders)
+	}
+	if err != nil {
+		return []models.Order{}, mapError(tracing.Error(span, err))
+	}
+
+	return orders, nil
+}
+
+// Insert writes a new order, its items and the transition that created it
+// in one transaction
+func (d *Order) Insert(ctx context.Context, order models.Order, created models.OrderTransition) (models.Order, error) {
+	conn, span := startSpan(ctx, "dao.Order.Insert")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		if err := tx.Insert(&order); err != nil {
+			return err
+		}
+		if err := insertItems(tx, order.Id, order.Items); err != nil {
+			return err
+		}
+		created.OrderId = order.Id
+		return tx.Insert(&created)
+	})
+	if err != nil {
+		return order, mapError(tracing.Error(span, err))
+	}
+
+	return order, nil
+}
+
+func (d *Order) FindById(ctx context.Context, id int64) (models.Order, error) {
+	order := models.Order{Id: id}
+
+	conn, span := startSpan(ctx, "dao.Order.FindById")
+	defer span.End()
+
+	err := conn.Model(&order).WherePK().Where("deleted_at IS NULL").Select()
+	if err == pg.ErrNoRows {
+		return order, ErrNotFound
+	}
+	if err == nil {
+		orders := []models.Order{order}
+		err = attachItems(conn, orders)
+		order = orders[0]
+	}
+	return order, mapError(tracing.Error(span, err))
+}
+
+// Update rewrites every stored field of an existing order and replaces its
+// items. It fails with ErrConflict if the order's status changed or it was
+// deleted since it was read.
+func (d *Order) Update(ctx context.Context, order models.Order) error {
+	conn, span := startSpan(ctx, "dao.Order.Update")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(&order).WherePK().Where("status = ?", order.Status).Where("deleted_at IS NULL").Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return ErrConflict
+		}
+
+		_, err = tx.Model(&models.LineItem{}).Where("order_id = ?", order.Id).Delete()
 		if err != nil {
 			return err
 		}
+		return insertItems(tx, order.Id, order.Items)
+	})
+	return mapError(tracing.Error(span, err))
+}
+
+// Transition moves an order from one status to another and records it in
+// the order's history. It fails with ErrConflict if the order is no longer
+// in the status the transition starts from.
+func (d *Order) Transition(ctx context.Context, order models.Order, transition models.OrderTransition) error {
+	conn, span := startSpan(ctx, "dao.Order.Transition")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(&order).
+			Column("status", "signature").
+			WherePK().
+			Where("status = ?", transition.From).
+			Where("deleted_at IS NULL").
+			Update()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return ErrConflict
+		}
+		return tx.Insert(&transition)
+	})
+	return mapError(tracing.Error(span, err))
+}
+
+// Transitions returns an order's history, oldest first
+func (d *Order) Transitions(ctx context.Context, id int64) ([]models.OrderTransition, error) {
+	var transitions []models.OrderTransition
+
+	conn, span := startSpan(ctx, "dao.Order.Transitions")
+	defer span.End()
+
+	err := conn.Model(&transitions).Where("order_id = ?", id).Order("id ASC").Select()
+	if err != nil {
+		return []models.OrderTransition{}, mapError(tracing.Error(span, err))
+	}
+
+	return transitions, nil
+}
+
+// Delete soft deletes an order. It stays restorable until it is purged.
+func (d *Order) Delete(ctx context.Context, id int64, now time.Time) error {
+	conn, span := startSpan(ctx, "dao.Order.Delete")
+	defer span.End()
+
+	res, err := conn.Model(&models.Order{}).
+		Set("deleted_at = ?", now).
+		Where("id = ?", id).
+		Where("deleted_at IS NULL").
+		Update()
+	if err != nil {
+		return mapError(tracing.Error(span, err))
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
 	}
+	return nil
+}
+
+// Restore brings back a soft deleted order that hasn't been purged
+func (d *Order) Restore(ctx context.Context, id int64) error {
+	conn, span := startSpan(ctx, "dao.Order.Restore")
+	defer span.End()
 
+	res, err := conn.Model(&models.Order{}).
+		Set("deleted_at = NULL").
+		Where("id = ?", id).
+		Where("deleted_at IS NOT NULL AND purged_at IS NULL").
+		Update()
+	if err != nil {
+		return mapError(tracing.Error(span, err))
+	}
+	if res.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 	return nil
 }
 
-func (d *Order) Insert(order models.Order) (models.Order, error) {
-	err := db.Insert(&order)
+// Purge hard deletes up to limit orders soft deleted before the cutoff, with
+// their items, history and stored idempotent responses
+func (d *Order) Purge(ctx context.Context, before time.Time, limit int) ([]int64, error) {
+	var ids []int64
+
+	conn, span := startSpan(ctx, "dao.Order.Purge")
+	defer span.End()
+
+	_, err := conn.Query(&ids, `
+		WITH purged AS (
+			DELETE FROM orders WHERE id IN (
+				SELECT id FROM orders
+				WHERE deleted_at < ?
+				ORDER BY id ASC
+				LIMIT ?)
+			RETURNING id
+		), responses AS (
+			DELETE FROM idempotency_keys WHERE order_id IN (SELECT id FROM purged)
+		)
+		SELECT id FROM purged`,
+		before, limit)
 	if err != nil {
-		return order, err
+		return ids, mapError(tracing.Error(span, err))
 	}
 
-	return order, nil
+	return ids, nil
+}
+
+// Shred strips the customer from up to limit orders soft deleted before the
+// cutoff. The context each order was encrypted under is tombstoned in the
+// same statement, so copies of its ciphertext in backups are never decrypted
+// again. That's the order's own key context, or for orders from before key
+// contexts the blind index of the customer's name, which like an erasure by
+// name also stops the name's other orders up to now being decrypted. Orders
+// that reference a customer hold no name, so have nothing to tombstone. The
+// ciphertext, blind index, mask and customer reference are dropped so
+// nothing links the row to a person, and the rest is kept for reporting.
+// Stored idempotent responses hold the name too, so they are deleted.
+func (d *Order) Shred(ctx context.Context, before time.Time, now time.Time, limit int) ([]int64, error) {
+	var ids []int64
+
+	conn, span := startSpan(ctx, "dao.Order.Shred")
+	defer span.End()
+
+	_, err := conn.Query(&ids, `
+		WITH shredded AS (
+			UPDATE orders SET
+				customer_name = '',
+				customer_index = NULL,
+				key_context = NULL,
+				customer_mask = NULL,
+				customer_id = NULL,
+				signature = NULL,
+				purged_at = ?0
+			FROM (
+				SELECT id, CASE WHEN customer_id IS NULL
+					THEN coalesce(key_context, customer_index) END AS key_context
+				FROM orders
+				WHERE deleted_at < ?1 AND purged_at IS NULL
+				ORDER BY id ASC
+				LIMIT ?2
+				FOR UPDATE) old
+			WHERE orders.id = old.id
+			RETURNING orders.id, old.key_context
+		), tombstones AS (
+			INSERT INTO customer_tombstones (customer_index, erased_at)
+			SELECT DISTINCT key_context, ?0::timestamp FROM shredded WHERE key_context IS NOT NULL
+			ON CONFLICT (customer_index) DO UPDATE SET erased_at = EXCLUDED.erased_at
+		), responses AS (
+			DELETE FROM idempotency_keys WHERE order_id IN (SELECT id FROM shredded)
+		)
+		SELECT id FROM shredded`,
+		now, before, limit)
+	if err != nil {
+		return ids, mapError(tracing.Error(span, err))
+	}
+
+	return ids, nil
+}
+
+func (d *Order) FindByIds(ctx context.Context, ids []int64) ([]models.Order, error) {
+	var orders []models.Order
+
+	if len(ids) == 0 {
+		return orders, nil
+	}
+
+	conn, span := startSpan(ctx, "dao.Order.FindByIds")
+	defer span.End()
+
+	err := conn.Model(&orders).Where("id IN (?)", pg.In(ids)).Where("deleted_at IS NULL").Order("id ASC").Select()
+	if err == nil {
+		err = attachItems(conn, orders)
+	}
+	if err != nil {
+		return []models.Order{}, mapError(tracing.Error(span, err))
+	}
+
+	return orders, nil
+}
+
+func (d *Order) FindByCustomerIndex(ctx context.Context, index string) ([]models.Order, error) {
+	var orders []models.Order
+
+	conn, span := startSpan(ctx, "dao.Order.FindByCustomerIndex")
+	defer span.End()
+
+	//Match on the blind index
+	err := conn.Model(&orders).Where("customer_index = ?", index).Where("deleted_at IS NULL").Select()
+	if err == nil {
+		err = attachItems(conn, orders)
+	}
+	if err != nil {
+		return []models.Order{}, mapError(tracing.Error(span, err))
+	}
+
+	return orders, nil
+}
+
+// FindByCustomerId includes soft deleted orders so they stay consistent with
+// the customer if they are restored
+func (d *Order) FindByCustomerId(ctx context.Context, customerId int64) ([]models.Order, error) {
+	var orders []models.Order
+
+	conn, span := startSpan(ctx, "dao.Order.FindByCustomerId")
+	defer span.End()
+
+	err := conn.Model(&orders).Where("customer_id = ?", customerId).Order("id ASC").Select()
+	if err == nil {
+		err = attachItems(conn, orders)
+	}
+	if err != nil {
+		return []models.Order{}, mapError(tracing.Error(span, err))
+	}
+
+	return orders, nil
+}
+
+func (d *Order) FindUnindexed(ctx context.Context, after int64, limit int) ([]models.Order, error) {
+	var orders []models.Order
+
+	conn, span := startSpan(ctx, "dao.Order.FindUnindexed")
+	defer span.End()
+
+	//Rows written before the blind index, mask or key contexts existed, paged by id
+	err := conn.Model(&orders).
+		Where("customer_index IS NULL OR customer_index = '' OR customer_mask IS NULL OR customer_mask = '' "+
+			"OR (key_context IS NULL AND customer_id IS NULL)").
+		Where("purged_at IS NULL").
+		Where("id > ?", after).
+		Order("id ASC").
+		Limit(limit).
+		Select()
+	if err != nil {
+		return []models.Order{}, mapError(tracing.Error(span, err))
+	}
+
+	return orders, nil
+}
+
+// Reindex stores what the backfill changed. The transaction is marked so the
+// orders trigger doesn't announce it as a change to the order.
+func (d *Order) Reindex(ctx context.Context, order models.Order) error {
+	conn, span := startSpan(ctx, "dao.Order.Reindex")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SET LOCAL app.backfill = 'on'"); err != nil {
+			return err
+		}
+		_, err := tx.Model(&order).
+			Column("customer_name", "key_context", "customer_index", "customer_mask", "signature").
+			WherePK().
+			Update()
+		return err
+	})
+	return mapError(tracing.Error(span, err))
+}
+
+func insertItems(tx *pg.Tx, orderId int64, items []models.LineItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	for i := range items {
+		items[i].OrderId = orderId
+	}
+	_, err := tx.Model(&items).Insert()
+	return err
+}
+
+// Load the items of each order in one query and compute the totals
+func attachItems(conn *pg.DB, orders []models.Order) error {
+	var ids []int64
+	var items []models.LineItem
+
+	if len(orders) == 0 {
+		return nil
+	}
+	for _, order := range orders {
+		ids = append(ids, order.Id)
+	}
+
+	err := conn.Model(&items).Where("order_id IN (?)", pg.In(ids)).Order("id ASC").Select()
+	if err != nil {
+		return err
+	}
+
+	byOrder := make(map[int64][]models.LineItem)
+	for _, item := range items {
+		byOrder[item.OrderId] = append(byOrder[item.OrderId], item)
+	}
+	for i := range orders {
+		orders[i].SetItems(byOrder[orders[i].Id])
+	}
+
+	return nil
 }
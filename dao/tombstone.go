@@ -0,0 +1,115 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+type Tombstone struct{}
+
+func (d *Tombstone) FindByCustomerIndexes(ctx context.Context, indexes []string) (map[string]time.Time, error) {
+	var tombstones []models.Tombstone
+	erased := make(map[string]time.Time)
+
+	if len(indexes) == 0 {
+		return erased, nil
+	}
+
+	conn, span := startSpan(ctx, "dao.Tombstone.FindByCustomerIndexes")
+	defer span.End()
+
+	err := conn.Model(&tombstones).Where("customer_index IN (?)", pg.In(indexes)).Select()
+	if err != nil {
+		return erased, mapError(tracing.Error(span, err))
+	}
+
+	for _, tombstone := range tombstones {
+		erased[tombstone.CustomerIndex] = tombstone.ErasedAt
+	}
+
+	return erased, nil
+}
+
+// Erase deletes the orders and customer records derived from a customer
+// name index and records the tombstone in one transaction. Customers with
+// their own key context, and their orders, are left alone.
+func (d *Tombstone) Erase(ctx context.Context, index string, erasedAt time.Time) ([]int64, error) {
+	var ids []int64
+
+	conn, span := startSpan(ctx, "dao.Tombstone.Erase")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Model(&models.Order{}).
+			Where("customer_index = ?", index).
+			Where("customer_id IS NULL OR customer_id IN (SELECT id FROM customers WHERE customer_index = ? AND key_context IS NULL)", index).
+			Returning("id").
+			Delete(&ids)
+		if err != nil {
+			return err
+		}
+
+		//Stored responses hold the customer name too
+		_, err = tx.Model(&models.IdempotencyKey{}).Where("customer_index = ?", index).Delete()
+		if err != nil {
+			return err
+		}
+
+		//And so do customer records, once their orders are gone
+		_, err = tx.Model(&models.Customer{}).Where("customer_index = ?", index).Where("key_context IS NULL").Delete()
+		if err != nil {
+			return err
+		}
+
+		return tombstone(tx, index, erasedAt)
+	})
+
+	return ids, mapError(tracing.Error(span, err))
+}
+
+// EraseCustomer deletes one customer record and the orders that reference
+// it, and tombstones its key context, in one transaction
+func (d *Tombstone) EraseCustomer(ctx context.Context, id int64, keyContext string, erasedAt time.Time) ([]int64, error) {
+	var ids []int64
+
+	conn, span := startSpan(ctx, "dao.Tombstone.EraseCustomer")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		_, err := tx.Model(&models.Order{}).Where("customer_id = ?", id).Returning("id").Delete(&ids)
+		if err != nil {
+			return err
+		}
+
+		//Stored responses for those orders hold the customer name too
+		if len(ids) > 0 {
+			_, err = tx.Model(&models.IdempotencyKey{}).Where("order_id IN (?)", pg.In(ids)).Delete()
+			if err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Model(&models.Customer{}).Where("id = ?", id).Delete()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			return ErrCustomerNotFound
+		}
+
+		return tombstone(tx, keyContext, erasedAt)
+	})
+
+	return ids, mapError(tracing.Error(span, err))
+}
+
+// Keep the latest erasure if the customer is erased again
+func tombstone(tx *pg.Tx, context string, erasedAt time.Time) error {
+	tombstone := models.Tombstone{CustomerIndex: context, ErasedAt: erasedAt}
+	_, err := tx.Model(&tombstone).OnConflict("(customer_index) DO UPDATE").Set("erased_at = EXCLUDED.erased_at").Insert()
+	return err
+}
@@ -0,0 +1,16 @@
+package dao
+
+import (
+	"context"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Start a span for a DAO call and scope the connection to its context
+func startSpan(ctx context.Context, name string) (*pg.DB, trace.Span) {
+	ctx, span := tracing.Start(ctx, name, attribute.String("db.system", "postgresql"))
+	return db.WithContext(ctx), span
+}
@@ -0,0 +1,198 @@
+package dao
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+// Webhook keeps webhook subscriptions and their delivery outbox
+type Webhook struct{}
+
+func (d *Webhook) FindAll(ctx context.Context) ([]models.Webhook, error) {
+	var webhooks []models.Webhook
+
+	conn, span := startSpan(ctx, "dao.Webhook.FindAll")
+	defer span.End()
+
+	err := conn.Model(&webhooks).Order("id ASC").Select()
+	if err != nil {
+		return []models.Webhook{}, mapError(tracing.Error(span, err))
+	}
+
+	return webhooks, nil
+}
+
+func (d *Webhook) FindById(ctx context.Context, id int64) (models.Webhook, error) {
+	webhook := models.Webhook{Id: id}
+
+	conn, span := startSpan(ctx, "dao.Webhook.FindById")
+	defer span.End()
+
+	err := conn.Select(&webhook)
+	if err == pg.ErrNoRows {
+		return webhook, ErrWebhookNotFound
+	}
+	return webhook, mapError(tracing.Error(span, err))
+}
+
+func (d *Webhook) Insert(ctx context.Context, webhook models.Webhook) (models.Webhook, error) {
+	conn, span := startSpan(ctx, "dao.Webhook.Insert")
+	defer span.End()
+
+	err := conn.Insert(&webhook)
+	return webhook, mapError(tracing.Error(span, err))
+}
+
+func (d *Webhook) Update(ctx context.Context, webhook models.Webhook) error {
+	conn, span := startSpan(ctx, "dao.Webhook.Update")
+	defer span.End()
+
+	res, err := conn.Model(&webhook).Column("url", "events", "active").WherePK().Update()
+	if err != nil {
+		return mapError(tracing.Error(span, err))
+	}
+	if res.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Delete removes a webhook with its queued deliveries and dead letters
+func (d *Webhook) Delete(ctx context.Context, id int64) error {
+	conn, span := startSpan(ctx, "dao.Webhook.Delete")
+	defer span.End()
+
+	res, err := conn.Model(&models.Webhook{}).Where("id = ?", id).Delete()
+	if err != nil {
+		return mapError(tracing.Error(span, err))
+	}
+	if res.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Claim takes up to limit deliveries that are due and holds them until the
+// lease is up, so other workers skip them while they are sent. A delivery
+// whose worker dies is picked up again once its lease runs out.
+func (d *Webhook) Claim(ctx context.Context, now time.Time, lease time.Time, limit int) ([]models.WebhookDelivery, error) {
+	var deliveries []models.WebhookDelivery
+
+	conn, span := startSpan(ctx, "dao.Webhook.Claim")
+	defer span.End()
+
+	_, err := conn.Query(&deliveries, `
+		UPDATE webhook_outbox SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_outbox
+			WHERE next_attempt_at <= ?
+			ORDER BY id ASC
+			LIMIT ?
+			FOR UPDATE SKIP LOCKED)
+		RETURNING *`,
+		lease, now, limit)
+	if err != nil {
+		return []models.WebhookDelivery{}, mapError(tracing.Error(span, err))
+	}
+
+	return deliveries, nil
+}
+
+// Delivered removes a delivery from the outbox
+func (d *Webhook) Delivered(ctx context.Context, id int64) error {
+	conn, span := startSpan(ctx, "dao.Webhook.Delivered")
+	defer span.End()
+
+	_, err := conn.Model(&models.WebhookDelivery{}).Where("id = ?", id).Delete()
+	return mapError(tracing.Error(span, err))
+}
+
+// Retry records a failed attempt and when to try again
+func (d *Webhook) Retry(ctx context.Context, delivery models.WebhookDelivery) error {
+	conn, span := startSpan(ctx, "dao.Webhook.Retry")
+	defer span.End()
+
+	_, err := conn.Model(&delivery).Column("attempts", "next_attempt_at", "last_error").WherePK().Update()
+	return mapError(tracing.Error(span, err))
+}
+
+// DeadLetter moves a delivery out of the outbox once it has run out of
+// attempts
+func (d *Webhook) DeadLetter(ctx context.Context, delivery models.WebhookDelivery, failedAt time.Time) error {
+	conn, span := startSpan(ctx, "dao.Webhook.DeadLetter")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		res, err := tx.Model(&models.WebhookDelivery{}).Where("id = ?", delivery.Id).Delete()
+		if err != nil {
+			return err
+		}
+		//The webhook was deleted while we were sending
+		if res.RowsAffected() == 0 {
+			return nil
+		}
+		return tx.Insert(&models.DeadLetter{
+			Id:        delivery.Id,
+			WebhookId: delivery.WebhookId,
+			EventId:   delivery.EventId,
+			OrderId:   delivery.OrderId,
+			Type:      delivery.Type,
+			Time:      delivery.Time,
+			Attempts:  delivery.Attempts,
+			LastError: delivery.LastError,
+			FailedAt:  failedAt,
+		})
+	})
+	return mapError(tracing.Error(span, err))
+}
+
+func (d *Webhook) DeadLetters(ctx context.Context) ([]models.DeadLetter, error) {
+	var letters []models.DeadLetter
+
+	conn, span := startSpan(ctx, "dao.Webhook.DeadLetters")
+	defer span.End()
+
+	err := conn.Model(&letters).Order("id ASC").Select()
+	if err != nil {
+		return []models.DeadLetter{}, mapError(tracing.Error(span, err))
+	}
+
+	return letters, nil
+}
+
+// Redrive puts a dead letter back in the outbox with its attempts reset
+func (d *Webhook) Redrive(ctx context.Context, id int64, now time.Time) error {
+	conn, span := startSpan(ctx, "dao.Webhook.Redrive")
+	defer span.End()
+
+	err := conn.RunInTransaction(func(tx *pg.Tx) error {
+		letter := models.DeadLetter{Id: id}
+		err := tx.Model(&letter).WherePK().For("UPDATE").Select()
+		if err == pg.ErrNoRows {
+			return ErrDeadLetterNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Model(&letter).WherePK().Delete(); err != nil {
+			return err
+		}
+		return tx.Insert(&models.WebhookDelivery{
+			Id:            letter.Id,
+			WebhookId:     letter.WebhookId,
+			EventId:       letter.EventId,
+			OrderId:       letter.OrderId,
+			Type:          letter.Type,
+			Time:          letter.Time,
+			NextAttemptAt: now,
+		})
+	})
+	if err == ErrDeadLetterNotFound {
+		return err
+	}
+	return mapError(tracing.Error(span, err))
+}
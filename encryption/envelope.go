@@ -0,0 +1,254 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefixes for values sealed locally with a transit data key. A v1 data key
+// was derived under the field's own context, so per-record contexts cost a
+// data key each. A v2 data key is derived under a random context of its own,
+// stored with the value, and the field's context is bound as additional data
+// instead, so one data key seals fields across any number of contexts.
+const (
+	envelopePrefix = "envelope:"
+	envelopeV1     = "envelope:v1:"
+	envelopeV2     = "envelope:v2:"
+)
+
+// Upper bound on data keys held for encryption, and separately on unwrapped
+// data keys held for decryption
+const maxCachedKeys = 1024
+
+// Envelope encrypts locally with AES-GCM under transit data keys. A data key
+// is used for Uses encryptions or TTL, whichever comes first, and its wrapped
+// form is stored with every value it sealed. A field's derivation context is
+// bound to its value as GCM additional data, so a value only opens under the
+// context it was sealed with.
+type Envelope struct {
+	TTL  time.Duration
+	Uses int
+
+	mutex   sync.Mutex
+	active  map[string]*dataKey
+	wrapped map[string]*dataKey
+}
+
+type dataKey struct {
+	Plaintext []byte
+	Wrapped   string
+	//Derivation context the data key was wrapped under
+	Context string
+	Expires time.Time
+	Uses    int
+}
+
+func isEnvelope(value string) bool {
+	return strings.HasPrefix(value, envelopePrefix)
+}
+
+// Seal plaintext as envelope:v2:<wrapped key>:<key context>:<nonce and ciphertext>
+func (e *Envelope) seal(ctx context.Context, t *Transit, key string, derivation string, plaintext string) (string, error) {
+	dk, err := e.activeKey(ctx, t, key, len(derivation) > 0)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(dk.Plaintext)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(derivation))
+
+	return fmt.Sprintf("%s%s:%s:%s", envelopeV2,
+		base64.StdEncoding.EncodeToString([]byte(dk.Wrapped)),
+		base64.StdEncoding.EncodeToString([]byte(dk.Context)),
+		base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Open works on a nil Envelope so we can still read sealed rows in transit mode
+func (e *Envelope) open(ctx context.Context, t *Transit, key string, derivation string, value string) (string, error) {
+	var parts []string
+	var keyContext string
+	var additional []byte
+
+	switch {
+	case strings.HasPrefix(value, envelopeV1):
+		parts = strings.SplitN(strings.TrimPrefix(value, envelopeV1), ":", 2)
+		keyContext = derivation
+	case strings.HasPrefix(value, envelopeV2):
+		parts = strings.SplitN(strings.TrimPrefix(value, envelopeV2), ":", 3)
+		if len(parts) == 3 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return "", err
+			}
+			keyContext = string(decoded)
+			parts = []string{parts[0], parts[2]}
+		}
+		additional = []byte(derivation)
+	}
+	if len(parts) != 2 {
+		return "", errors.New("Malformed envelope ciphertext.")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	plainKey, err := e.unwrap(ctx, t, key, keyContext, string(wrapped))
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(plainKey)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("Malformed envelope ciphertext.")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// Hand out the current data key for a transit key, rotating it when spent.
+// Derived keys get a data key under a fresh random context.
+func (e *Envelope) activeKey(ctx context.Context, t *Transit, key string, derived bool) (*dataKey, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.active == nil {
+		e.active = make(map[string]*dataKey)
+	}
+
+	name := key
+	if derived {
+		name += "\x00derived"
+	}
+	dk := e.active[name]
+	if dk != nil && (time.Now().After(dk.Expires) || dk.Uses >= e.Uses) {
+		delete(e.active, name)
+		dk = nil
+	}
+	if dk == nil {
+		var keyContext string
+		if derived {
+			random := make([]byte, 16)
+			if _, err := rand.Read(random); err != nil {
+				return nil, err
+			}
+			keyContext = "envelope:" + base64.RawURLEncoding.EncodeToString(random)
+		}
+		plaintext, wrapped, err := t.Vault.DataKey(ctx, fmt.Sprintf("%s/datakey/plaintext/%s", t.Mount, key), keyContext)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := base64.StdEncoding.DecodeString(plaintext)
+		if err != nil {
+			return nil, err
+		}
+		dk = &dataKey{Plaintext: raw, Wrapped: wrapped, Context: keyContext, Expires: time.Now().Add(e.TTL)}
+		evict(e.active)
+		e.active[name] = dk
+		e.cache(dk)
+	}
+	dk.Uses++
+
+	return dk, nil
+}
+
+// Unwrap a stored data key, going to transit only on a cache miss
+func (e *Envelope) unwrap(ctx context.Context, t *Transit, key string, derivation string, wrapped string) ([]byte, error) {
+	if e != nil {
+		e.mutex.Lock()
+		dk, ok := e.wrapped[wrapped]
+		if ok && time.Now().After(dk.Expires) {
+			//Don't keep plaintext keys past their TTL
+			delete(e.wrapped, wrapped)
+			ok = false
+		}
+		e.mutex.Unlock()
+		if ok {
+			return dk.Plaintext, nil
+		}
+	}
+
+	plaintexts, errs, err := t.Vault.DecryptBatch(ctx, fmt.Sprintf("%s/decrypt/%s", t.Mount, key), []string{wrapped}, []string{derivation})
+	if err != nil {
+		return nil, err
+	}
+	if errs[0] != nil {
+		return nil, errs[0]
+	}
+	raw, err := base64.StdEncoding.DecodeString(plaintexts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if e != nil {
+		e.mutex.Lock()
+		e.cache(&dataKey{Plaintext: raw, Wrapped: wrapped, Expires: time.Now().Add(e.TTL)})
+		e.mutex.Unlock()
+	}
+
+	return raw, nil
+}
+
+// Callers must hold the mutex
+func (e *Envelope) cache(dk *dataKey) {
+	if e.wrapped == nil {
+		e.wrapped = make(map[string]*dataKey)
+	}
+
+	evict(e.wrapped)
+	e.wrapped[dk.Wrapped] = dk
+}
+
+// Make room in a full key map by dropping expired keys, then the oldest if
+// we are still full. Callers must hold the mutex.
+func evict(keys map[string]*dataKey) {
+	if len(keys) < maxCachedKeys {
+		return
+	}
+
+	var oldest string
+	for name, cached := range keys {
+		if time.Now().After(cached.Expires) {
+			delete(keys, name)
+		} else if len(oldest) == 0 || cached.Expires.Before(keys[oldest].Expires) {
+			oldest = name
+		}
+	}
+	if len(keys) >= maxCachedKeys && len(oldest) > 0 {
+		delete(keys, oldest)
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,118 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnvelopeSealOpen(t *testing.T) {
+	cases := []struct {
+		name       string
+		derivation string
+		open       string
+		wantErr    bool
+	}{
+		{"no context", "", "", false},
+		{"context", "order-1", "order-1", false},
+		{"wrong context", "order-1", "order-2", true},
+		{"context dropped", "order-1", "", true},
+		{"context added", "", "order-1", true},
+	}
+
+	transit, _ := newFakeVault(t)
+	envelope := &Envelope{TTL: time.Minute, Uses: 10}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sealed, err := envelope.seal(context.Background(), transit, "order", c.derivation, "Lance")
+			if err != nil {
+				t.Fatalf("seal() = %v", err)
+			}
+			if !strings.HasPrefix(sealed, envelopeV2) || strings.Contains(sealed, "Lance") {
+				t.Fatalf("seal() = %q, want an %s value", sealed, envelopeV2)
+			}
+
+			plaintext, err := envelope.open(context.Background(), transit, "order", c.open, sealed)
+			if c.wantErr {
+				if err == nil {
+					t.Errorf("open() = %q, want an error", plaintext)
+				}
+				return
+			}
+			if err != nil || plaintext != "Lance" {
+				t.Errorf("open() = %q, %v, want Lance", plaintext, err)
+			}
+		})
+	}
+}
+
+func TestEnvelopeOpensV1(t *testing.T) {
+	transit, _ := newFakeVault(t)
+
+	//v1 data keys were derived under the field's context and bound nothing else
+	plaintext, wrapped, err := transit.Vault.DataKey(context.Background(), "transit/datakey/plaintext/order", "customer-1")
+	if err != nil {
+		t.Fatalf("DataKey() = %v", err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(plaintext)
+	gcm, _ := newGCM(raw)
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	value := fmt.Sprintf("%s%s:%s", envelopeV1,
+		base64.StdEncoding.EncodeToString([]byte(wrapped)),
+		base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("Lance"), nil)))
+
+	var envelope *Envelope
+	if got, err := envelope.open(context.Background(), transit, "order", "customer-1", value); err != nil || got != "Lance" {
+		t.Errorf("open() = %q, %v, want Lance", got, err)
+	}
+	if _, err := envelope.open(context.Background(), transit, "order", "customer-2", value); err == nil {
+		t.Error("open() under another context succeeded")
+	}
+}
+
+// Every record having its own context mustn't cost a data key per record
+func TestEnvelopeSharesDataKeysAcrossContexts(t *testing.T) {
+	transit, fake := newFakeVault(t)
+	transit.Envelope = &Envelope{TTL: time.Minute, Uses: 1000}
+
+	var records []record
+	for i := 0; i < 100; i++ {
+		records = append(records, record{Name: "Lance", Context: fmt.Sprintf("order-%d", i), Email: "lance@example.com"})
+	}
+	if err := transit.Encrypt(context.Background(), &records); err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	if n := fake.count("datakey"); n != 2 {
+		t.Errorf("Encrypt() fetched %d data keys, want one underived and one derived", n)
+	}
+
+	failed, err := transit.Decrypt(context.Background(), &records)
+	if err != nil {
+		t.Fatalf("Decrypt() = %v", err)
+	}
+	for i, f := range failed {
+		if f != nil || records[i].Name != "Lance" || records[i].Email != "lance@example.com" {
+			t.Fatalf("record %d = %+v, %v", i, records[i], f)
+		}
+	}
+	if n := fake.count("decrypt"); n != 0 {
+		t.Errorf("Decrypt() made %d transit calls, want the cached data keys used", n)
+	}
+
+	//A cold cache unwraps each data key once
+	if err := transit.Encrypt(context.Background(), &records); err != nil {
+		t.Fatalf("Encrypt() = %v", err)
+	}
+	transit.Envelope = &Envelope{TTL: time.Minute, Uses: 1000}
+	if _, err := transit.Decrypt(context.Background(), &records); err != nil {
+		t.Fatalf("Decrypt() = %v", err)
+	}
+	if n := fake.count("decrypt"); n != 2 {
+		t.Errorf("Decrypt() with a cold cache made %d transit calls, want 2", n)
+	}
+}
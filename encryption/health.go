@@ -0,0 +1,57 @@
+package encryption
+
+import (
+	"context"
+	"time"
+
+	"github.com/dimiro1/health"
+)
+
+// How long a readiness probe waits on Vault
+const probeTimeout = 5 * time.Second
+
+type probe struct {
+	Value   string `vault:"transit,context=Context"`
+	Context string
+}
+
+// Checker round-trips a fixed value through encrypt and decrypt with the
+// configured key and mode, so it fails if we could not serve an order.
+func (t *Transit) Checker() health.Checker {
+	return health.CheckerFunc(func() health.Health {
+		h := health.NewHealth()
+		mode := "transit"
+		if t.Envelope != nil {
+			mode = "envelope"
+		}
+		h.AddInfo("key", t.Key)
+		h.AddInfo("mode", mode)
+
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		defer cancel()
+
+		p := probe{Value: "readiness", Context: "readiness"}
+		if err := t.Encrypt(ctx, &p); err != nil {
+			h.Down()
+			h.AddInfo("error", err.Error())
+			return h
+		}
+		failed, err := t.Decrypt(ctx, &p)
+		if err == nil && failed[0] != nil {
+			err = failed[0]
+		}
+		if err != nil {
+			h.Down()
+			h.AddInfo("error", err.Error())
+			return h
+		}
+
+		if p.Value != "readiness" {
+			h.Down()
+			h.AddInfo("error", "Round-trip returned a different value")
+		} else {
+			h.Up()
+		}
+		return h
+	})
+}
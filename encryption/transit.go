@@ -0,0 +1,279 @@
+// Package encryption encrypts and decrypts model fields tagged for Vault transit.
+//
+// A string field is encrypted when it carries a vault tag:
+//
+//	CustomerName string `vault:"transit"`
+//	Email        string `vault:"transit,key=customer"`
+//	Phone        string `vault:"transit,context=CustomerIndex"`
+//
+// Fields without a key use the Transit default key. A context names another
+// string field whose value is sent as the derivation context, so the transit
+// key must be created with derived=true. Values are base64 encoded
+// before they are sent to transit and decoded on the way back, so callers only
+// deal with plaintext strings.
+package encryption
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/lanceplarsen/go-vault-demo/client"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+type Transit struct {
+	Vault *client.Vault
+	Mount string
+	Key   string
+	//Non-derived key that values without a derivation context were
+	//encrypted under before contexts existed. Only used to decrypt.
+	LegacyKey string
+	//Seal locally with data keys instead of a transit round-trip per field
+	Envelope *Envelope
+}
+
+type taggedField struct {
+	Index   int
+	Key     string
+	Context string
+}
+
+// A single string field on a single model waiting on transit
+type target struct {
+	Item    int
+	Value   reflect.Value
+	Context string
+}
+
+// Encrypt replaces every tagged field on a model pointer or slice of models
+// with transit ciphertext. Fields are encrypted in one batch per key.
+func (t *Transit) Encrypt(ctx context.Context, models interface{}) error {
+	ctx, span := tracing.Start(ctx, "encryption.Transit.Encrypt")
+	defer span.End()
+
+	targets, err := t.collect(models, false)
+	if err != nil {
+		return err
+	}
+
+	for key, fields := range targets {
+		if t.Envelope != nil {
+			for _, f := range fields {
+				sealed, err := t.Envelope.seal(ctx, t, key, f.Context, f.Value.String())
+				if err != nil {
+					return err
+				}
+				f.Value.SetString(sealed)
+			}
+			continue
+		}
+
+		var plaintexts []string
+		var contexts []string
+		for _, f := range fields {
+			plaintexts = append(plaintexts, base64.StdEncoding.EncodeToString([]byte(f.Value.String())))
+			contexts = append(contexts, f.Context)
+		}
+
+		ciphertexts, errs, err := t.Vault.EncryptBatch(ctx, fmt.Sprintf("%s/encrypt/%s", t.Mount, key), plaintexts, contexts)
+		if err != nil {
+			return err
+		}
+
+		//We can't store a partially encrypted model so any failure fails the write
+		for i, f := range fields {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			f.Value.SetString(ciphertexts[i])
+		}
+	}
+
+	return nil
+}
+
+// Decrypt replaces every tagged field on a model pointer or slice of models
+// with its plaintext. The returned slice has an entry per model which is
+// non-nil when any of that model's fields could not be decrypted.
+func (t *Transit) Decrypt(ctx context.Context, models interface{}) ([]error, error) {
+	ctx, span := tracing.Start(ctx, "encryption.Transit.Decrypt")
+	defer span.End()
+
+	targets, err := t.collect(models, true)
+	if err != nil {
+		return nil, err
+	}
+	failed := make([]error, count(models))
+
+	for key, all := range targets {
+		var fields []target
+		var ciphertexts []string
+		var contexts []string
+
+		//Envelope values are opened locally whatever mode we write in
+		for _, f := range all {
+			if !isEnvelope(f.Value.String()) {
+				fields = append(fields, f)
+				ciphertexts = append(ciphertexts, f.Value.String())
+				contexts = append(contexts, f.Context)
+				continue
+			}
+			plaintext, err := t.Envelope.open(ctx, t, key, f.Context, f.Value.String())
+			if err != nil {
+				failed[f.Item] = err
+				continue
+			}
+			f.Value.SetString(plaintext)
+		}
+
+		plaintexts, errs, err := t.Vault.DecryptBatch(ctx, fmt.Sprintf("%s/decrypt/%s", t.Mount, key), ciphertexts, contexts)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, f := range fields {
+			if errs[i] != nil {
+				failed[f.Item] = errs[i]
+				continue
+			}
+			sDec, err := base64.StdEncoding.DecodeString(plaintexts[i])
+			if err != nil {
+				failed[f.Item] = err
+				continue
+			}
+			f.Value.SetString(string(sDec))
+		}
+	}
+
+	return failed, nil
+}
+
+// Group every non-empty tagged field by transit key. When decrypting, fields
+// that take a context but have none go to the legacy key if there is one.
+func (t *Transit) collect(models interface{}, decrypt bool) (map[string][]target, error) {
+	targets := make(map[string][]target)
+
+	items, err := elements(models)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, item := range items {
+		fields, err := taggedFields(item.Type())
+		if err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			value := item.Field(field.Index)
+			if len(value.String()) == 0 {
+				continue
+			}
+			key := field.Key
+			if len(key) == 0 {
+				key = t.Key
+			}
+			var derivation string
+			if len(field.Context) > 0 {
+				derivation = item.FieldByName(field.Context).String()
+				if decrypt && len(derivation) == 0 && len(field.Key) == 0 && len(t.LegacyKey) > 0 {
+					key = t.LegacyKey
+				}
+			}
+			targets[key] = append(targets[key], target{Item: i, Value: value, Context: derivation})
+		}
+	}
+
+	return targets, nil
+}
+
+// Look up the transit tagged fields of a model type
+func taggedFields(typ reflect.Type) ([]taggedField, error) {
+	var fields []taggedField
+
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+		tag, ok := sf.Tag.Lookup("vault")
+		if !ok {
+			continue
+		}
+
+		opts := strings.Split(tag, ",")
+		if opts[0] != "transit" {
+			return nil, fmt.Errorf("Unsupported vault tag %q on %s.%s", tag, typ.Name(), sf.Name)
+		}
+		if sf.Type.Kind() != reflect.String {
+			return nil, fmt.Errorf("Vault tagged field %s.%s must be a string", typ.Name(), sf.Name)
+		}
+
+		field := taggedField{Index: i}
+		for _, opt := range opts[1:] {
+			kv := strings.SplitN(opt, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("Unsupported vault tag option %q on %s.%s", opt, typ.Name(), sf.Name)
+			}
+			switch kv[0] {
+			case "key":
+				field.Key = kv[1]
+			case "context":
+				cf, ok := typ.FieldByName(kv[1])
+				if !ok || cf.Type.Kind() != reflect.String {
+					return nil, fmt.Errorf("Context field %s.%s must be a string", typ.Name(), kv[1])
+				}
+				field.Context = kv[1]
+			default:
+				return nil, fmt.Errorf("Unsupported vault tag option %q on %s.%s", opt, typ.Name(), sf.Name)
+			}
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// Accept *Model, *[]Model or []Model and hand back settable structs
+func elements(models interface{}) ([]reflect.Value, error) {
+	var items []reflect.Value
+
+	v := reflect.ValueOf(models)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		if !v.CanSet() {
+			return nil, errors.New("Model must be passed by pointer.")
+		}
+		items = append(items, v)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			item := v.Index(i)
+			if item.Kind() == reflect.Ptr {
+				item = item.Elem()
+			}
+			if item.Kind() != reflect.Struct {
+				return nil, fmt.Errorf("Cannot encrypt fields of %s", item.Type())
+			}
+			items = append(items, item)
+		}
+	default:
+		return nil, fmt.Errorf("Cannot encrypt fields of %s", v.Type())
+	}
+
+	return items, nil
+}
+
+func count(models interface{}) int {
+	v := reflect.ValueOf(models)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Slice {
+		return v.Len()
+	}
+	return 1
+}
@@ -0,0 +1,211 @@
+package encryption
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/lanceplarsen/go-vault-demo/client"
+)
+
+type record struct {
+	Name    string `vault:"transit"`
+	Context string
+	Email   string `vault:"transit,context=Context"`
+}
+
+// fakeVault answers token lookups and the transit endpoints the package
+// uses. Ciphertexts are vault:v1:<context>:<plaintext> so a wrong context or
+// a mangled value fails like it would against a real derived key, and
+// batches answer with the status transit uses for partial failures.
+type fakeVault struct {
+	mutex sync.Mutex
+	calls map[string]int
+}
+
+func newFakeVault(t *testing.T) (*Transit, *fakeVault) {
+	fake := &fakeVault{calls: make(map[string]int)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	vault := &client.Vault{
+		Scheme:         u.Scheme,
+		Host:           host,
+		Port:           port,
+		Authentication: "token",
+		Credential:     client.Credential{Token: "test"},
+	}
+	if err := vault.Initialize(); err != nil {
+		t.Fatalf("Initialize() = %v", err)
+	}
+
+	return &Transit{Vault: vault, Mount: "transit", Key: "order"}, fake
+}
+
+// Count calls to an operation, or to an operation on one key like decrypt/order
+func (f *fakeVault) count(operation string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[operation]
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/v1/auth/token/lookup-self" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"renewable": false, "ttl": 3600},
+		})
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	f.mutex.Lock()
+	f.calls[parts[0]]++
+	f.calls[strings.Join(parts, "/")]++
+	f.mutex.Unlock()
+
+	var body struct {
+		Context            string                   `json:"context"`
+		BatchInput         []map[string]interface{} `json:"batch_input"`
+		PartialFailureCode int                      `json:"partial_failure_response_code"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	switch parts[0] {
+	case "datakey":
+		raw := make([]byte, 32)
+		rand.Read(raw)
+		plaintext := base64.StdEncoding.EncodeToString(raw)
+		writeData(w, http.StatusOK, map[string]interface{}{
+			"plaintext":  plaintext,
+			"ciphertext": "vault:v1:" + body.Context + ":" + plaintext,
+		})
+	case "encrypt", "decrypt":
+		var results []map[string]interface{}
+		var ok, failed bool
+		for _, item := range body.BatchInput {
+			derivation, _ := item["context"].(string)
+			result := map[string]interface{}{}
+			if parts[0] == "encrypt" {
+				result["ciphertext"] = "vault:v1:" + derivation + ":" + item["plaintext"].(string)
+			} else if fields := strings.SplitN(item["ciphertext"].(string), ":", 4); len(fields) == 4 && fields[2] == derivation {
+				result["plaintext"] = fields[3]
+			} else {
+				result["error"] = "cipher: message authentication failed"
+			}
+			if _, bad := result["error"]; bad {
+				failed = true
+			} else {
+				ok = true
+			}
+			results = append(results, result)
+		}
+
+		status := http.StatusOK
+		if failed {
+			status = http.StatusBadRequest
+			if ok && body.PartialFailureCode > 0 {
+				status = body.PartialFailureCode
+			}
+		}
+		writeData(w, status, map[string]interface{}{"batch_results": results})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeData(w http.ResponseWriter, status int, data map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func TestDecryptFailsOnlyBadRecords(t *testing.T) {
+	cases := []struct {
+		name string
+		bad  []bool
+	}{
+		{"none bad", []bool{false, false, false}},
+		{"one bad", []bool{false, true, false}},
+		{"all bad", []bool{true, true, true}},
+		{"single bad", []bool{true}},
+	}
+
+	transit, _ := newFakeVault(t)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var records []record
+			for i := range c.bad {
+				records = append(records, record{Name: "Lance", Context: "customer-" + string(rune('a'+i)), Email: "lance@example.com"})
+			}
+			if err := transit.Encrypt(context.Background(), &records); err != nil {
+				t.Fatalf("Encrypt() = %v", err)
+			}
+			for i, bad := range c.bad {
+				if bad {
+					records[i].Context = "someone-else"
+				}
+			}
+
+			failed, err := transit.Decrypt(context.Background(), &records)
+			if err != nil {
+				t.Fatalf("Decrypt() = %v, want per record errors", err)
+			}
+			for i, bad := range c.bad {
+				if bad && failed[i] == nil {
+					t.Errorf("record %d decrypted under the wrong context", i)
+				}
+				if !bad && failed[i] != nil {
+					t.Errorf("record %d failed: %v", i, failed[i])
+				}
+				if !bad && (records[i].Name != "Lance" || records[i].Email != "lance@example.com") {
+					t.Errorf("record %d = %+v, want plaintext", i, records[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptLegacyKey(t *testing.T) {
+	cases := []struct {
+		name      string
+		context   string
+		legacyKey string
+		want      string
+	}{
+		{"context", "order-1", "order", "decrypt/order-derived"},
+		{"no context", "", "order", "decrypt/order"},
+		{"no legacy key", "", "", "decrypt/order-derived"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			transit, fake := newFakeVault(t)
+			transit.Key = "order-derived"
+			transit.LegacyKey = c.legacyKey
+
+			r := record{Context: c.context, Email: "lance@example.com"}
+			if err := transit.Encrypt(context.Background(), &r); err != nil {
+				t.Fatalf("Encrypt() = %v", err)
+			}
+			if _, err := transit.Decrypt(context.Background(), &r); err != nil {
+				t.Fatalf("Decrypt() = %v", err)
+			}
+			if n := fake.count(c.want); n != 1 {
+				t.Errorf("%s called %d times, want 1", c.want, n)
+			}
+			if n := fake.count("encrypt/order-derived"); n != 1 {
+				t.Errorf("encrypt/order-derived called %d times, want 1", n)
+			}
+		})
+	}
+}
@@ -131,7 +131,7 @@ serviceaccount="/var/run/secrets/kubernetes.io/serviceaccount/token"
 mount="database"
 role="order"
 [vault.transit]
-key="order"
+key="order-derived"
 mount="transit"
 EOF
   }
@@ -0,0 +1,131 @@
+// Package logging sets up the shared leveled logger. Everything it emits
+// goes through a redacting formatter so secrets and customer PII can't
+// reach the logs, even when they are passed in by mistake.
+package logging
+
+import (
+	"fmt"
+	stdlog "log"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type Config struct {
+	//debug, info, warn or error
+	Level string
+	//text or json
+	Format string
+}
+
+const Redacted = "[REDACTED]"
+
+// Field names are compared lower case with dashes and underscores removed
+var sensitiveFields = map[string]bool{
+	"authorization": true,
+	"clienttoken":   true,
+	"credential":    true,
+	"customer":      true,
+	"customername":  true,
+	"jwt":           true,
+	"password":      true,
+	"plaintext":     true,
+	"secretid":      true,
+	"token":         true,
+}
+
+type pattern struct {
+	match   *regexp.Regexp
+	replace string
+}
+
+// Secrets we can recognize by shape wherever they turn up in a message
+var sensitivePatterns = []pattern{
+	//Vault service, batch and legacy tokens
+	{regexp.MustCompile(`\b(hvs|hvb|hvr|s|b|r)\.[A-Za-z0-9_-]{20,}`), Redacted},
+	//JWTs
+	{regexp.MustCompile(`\beyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), Redacted},
+	//Bearer credentials in headers
+	{regexp.MustCompile(`(?i)\bbearer\s+[^\s"]+`), "Bearer " + Redacted},
+	//key=value and "key":"value" pairs
+	{regexp.MustCompile(`(?i)(password|secret[_-]?id|token)(["']?\s*[=:]\s*["']?)[^\s"',}&]+`), "${1}${2}" + Redacted},
+	//Credentials embedded in URLs
+	{regexp.MustCompile(`(://[^:/\s]+:)[^@/\s]+@`), "${1}" + Redacted + "@"},
+}
+
+// Init configures the standard logrus logger and routes the standard
+// library logger through it so third party output is redacted too.
+func Init(c Config) error {
+	level, err := log.ParseLevel(c.Level)
+	if err != nil {
+		return err
+	}
+
+	var formatter log.Formatter
+	switch c.Format {
+	case "text":
+		formatter = &log.TextFormatter{FullTimestamp: true}
+	case "json":
+		formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("Log format %s is not supported", c.Format)
+	}
+
+	log.SetOutput(os.Stderr)
+	log.SetLevel(level)
+	log.SetFormatter(&Redactor{Formatter: formatter})
+
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.StandardLogger().WriterLevel(log.InfoLevel))
+
+	return nil
+}
+
+// Redactor scrubs an entry before handing it to the wrapped formatter
+type Redactor struct {
+	Formatter log.Formatter
+}
+
+func (r *Redactor) Format(entry *log.Entry) ([]byte, error) {
+	//Work on a copy so fields shared with other entries stay untouched
+	clean := *entry
+	clean.Message = RedactString(entry.Message)
+	clean.Data = make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		clean.Data[key] = RedactField(key, value)
+	}
+
+	return r.Formatter.Format(&clean)
+}
+
+// RedactField masks the whole value for sensitive field names and scrubs
+// anything else that renders as a string.
+func RedactField(key string, value interface{}) interface{} {
+	name := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(key))
+	if sensitiveFields[name] {
+		return Redacted
+	}
+
+	switch v := value.(type) {
+	case nil, bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return RedactString(v.Error())
+	case string:
+		return RedactString(v)
+	case fmt.Stringer:
+		return RedactString(v.String())
+	default:
+		return RedactString(fmt.Sprintf("%+v", v))
+	}
+}
+
+// RedactString replaces anything shaped like a secret
+func RedactString(s string) string {
+	for _, p := range sensitivePatterns {
+		s = p.match.ReplaceAllString(s, p.replace)
+	}
+	return s
+}
@@ -0,0 +1,202 @@
+// Package metrics exposes Prometheus metrics for the HTTP API, Vault and
+// Postgres.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "go_vault_demo"
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	transitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "vault_transit_duration_seconds",
+		Help:      "Transit request latency by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	transitErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vault_transit_errors_total",
+		Help:      "Failed transit requests by operation.",
+	}, []string{"operation"})
+
+	tokenTTL = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vault_token_ttl_seconds",
+		Help:      "TTL of the Vault token at its last login or renewal.",
+	})
+	leaseTTL = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vault_lease_ttl_seconds",
+		Help:      "TTL of each secret lease at its last renewal, by secret path.",
+	}, []string{"path"})
+	renewals = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vault_renewals_total",
+		Help:      "Token and lease renewals by kind and result.",
+	}, []string{"kind", "result"})
+	logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "vault_auth_total",
+		Help:      "Vault logins by auth method and result.",
+	}, []string{"method", "result"})
+
+	dbDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Postgres query latency by statement.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"statement"})
+	dbErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "db_query_errors_total",
+		Help:      "Failed Postgres queries by statement.",
+	}, []string{"statement"})
+
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Webhook delivery attempts by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, transitDuration, transitErrors,
+		tokenTTL, leaseTTL, renewals, logins, dbDuration, dbErrors, webhookDeliveries)
+}
+
+func ObserveTransit(operation string, start time.Time, err error) {
+	transitDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		transitErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+func ObserveQuery(statement string, start time.Time, err error) {
+	dbDuration.WithLabelValues(statement).Observe(time.Since(start).Seconds())
+	if err != nil {
+		dbErrors.WithLabelValues(statement).Inc()
+	}
+}
+
+func SetTokenTTL(ttl int) {
+	tokenTTL.Set(float64(ttl))
+}
+
+func SetLeaseTTL(path string, ttl int) {
+	leaseTTL.WithLabelValues(path).Set(float64(ttl))
+}
+
+// Renewal counts a token or lease renewal attempt
+func Renewal(kind string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	renewals.WithLabelValues(kind, result).Inc()
+}
+
+func Login(method string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	logins.WithLabelValues(method, result).Inc()
+}
+
+// WebhookDelivery counts a delivery attempt that was delivered, will be
+// retried or was dead-lettered
+func WebhookDelivery(result string) {
+	webhookDeliveries.WithLabelValues(result).Inc()
+}
+
+type PoolStats struct {
+	Hits       uint32
+	Misses     uint32
+	Timeouts   uint32
+	TotalConns uint32
+	IdleConns  uint32
+	StaleConns uint32
+}
+
+// RegisterPool exports connection pool stats read at scrape time
+func RegisterPool(stats func() PoolStats) {
+	gauge := func(name string, help string, value func(PoolStats) uint32) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(stats())) })
+	}
+	counter := func(name string, help string, value func(PoolStats) uint32) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      name,
+			Help:      help,
+		}, func() float64 { return float64(value(stats())) })
+	}
+
+	prometheus.MustRegister(
+		counter("db_pool_hits_total", "Times a free connection was found in the pool.", func(s PoolStats) uint32 { return s.Hits }),
+		counter("db_pool_misses_total", "Times a free connection was not found in the pool.", func(s PoolStats) uint32 { return s.Misses }),
+		counter("db_pool_timeouts_total", "Times a wait for a connection timed out.", func(s PoolStats) uint32 { return s.Timeouts }),
+		gauge("db_pool_connections", "Connections in the pool.", func(s PoolStats) uint32 { return s.TotalConns }),
+		gauge("db_pool_idle_connections", "Idle connections in the pool.", func(s PoolStats) uint32 { return s.IdleConns }),
+		counter("db_pool_stale_connections_total", "Stale connections removed from the pool.", func(s PoolStats) uint32 { return s.StaleConns }),
+	)
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Streamed responses like exports and event streams need to flush through us
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Middleware records request counts and latency by mux route template
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		//Label by template so ids in paths don't explode cardinality
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		status := strconv.Itoa(sw.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type AuditEntry struct {
+	tableName struct{}  `sql:"audit_log"`
+	Seq       int64     `json:"seq" sql:",pk"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Caller    string    `json:"caller"`
+	Method    string    `json:"method"`
+	RequestID string    `json:"request_id"`
+	OrderIDs  []int64   `json:"order_ids" sql:",array"`
+	Prev      string    `json:"prev"`
+	HMAC      string    `json:"hmac" sql:"hmac"`
+}
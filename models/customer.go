@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// Customer holds a customer's contact details once so orders can reference
+// them by id. The contact fields are encrypted under a key derived from a
+// random context of the customer's own, so customers who share a name don't
+// share a key and erasing one leaves the others readable.
+type Customer struct {
+	tableName       struct{}  `sql:"customers"`
+	Id              int64     `json:"id"`
+	Name            string    `json:"Name" vault:"transit,context=KeyContext"`
+	Email           string    `json:"Email" vault:"transit,context=KeyContext"`
+	Phone           string    `json:"Phone,omitempty" vault:"transit,context=KeyContext"`
+	ShippingAddress string    `json:"ShippingAddress,omitempty" vault:"transit,context=KeyContext"`
+	CustomerIndex   string    `json:"-"`
+	KeyContext      string    `json:"-"`
+	NameMask        string    `json:"-"`
+	EmailIndex      string    `json:"-"`
+	CreatedAt       time.Time `json:"CreatedAt"`
+	UpdatedAt       time.Time `json:"UpdatedAt"`
+}
@@ -0,0 +1,24 @@
+package models
+
+import "time"
+
+// Order event types
+const (
+	EventCreated  = "created"
+	EventUpdated  = "updated"
+	EventDeleted  = "deleted"
+	EventRestored = "restored"
+)
+
+// OrderEvent is one change to the orders table, written by its trigger.
+// Position is its place in the feed, set once it has committed. Order is
+// filled in for the caller when it still exists.
+type OrderEvent struct {
+	tableName struct{}  `sql:"order_events"`
+	Id        int64     `json:"id"`
+	Position  int64     `json:"-"`
+	OrderId   int64     `json:"OrderId"`
+	Type      string    `json:"Type"`
+	Time      time.Time `json:"Time"`
+	Order     *Order    `sql:"-" json:"Order,omitempty"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// IdempotencyKey remembers the order created for a caller's key. The
+// response is encrypted with the customer name's blind index as its key
+// context, not the order's own, so it is deleted along with the order's
+// customer data when the order is erased, shredded or purged.
+type IdempotencyKey struct {
+	tableName     struct{} `sql:"idempotency_keys"`
+	Caller        string   `sql:",pk"`
+	Key           string   `sql:",pk"`
+	Fingerprint   string
+	OrderId       int64
+	CustomerIndex string
+	Response      string `vault:"transit,context=CustomerIndex"`
+	CreatedAt     time.Time
+	ExpiresAt     time.Time
+}
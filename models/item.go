@@ -0,0 +1,27 @@
+package models
+
+// LineItem is one product on an order. Prices are in the currency's minor
+// unit, like cents, so totals are exact.
+type LineItem struct {
+	tableName struct{} `sql:"order_items"`
+	Id        int64    `json:"-"`
+	OrderId   int64    `json:"-"`
+	Sku       string   `json:"Sku"`
+	Quantity  int64    `json:"Quantity"`
+	UnitPrice int64    `json:"UnitPrice"`
+	Currency  string   `json:"Currency"`
+	Total     int64    `json:"Total"`
+}
+
+// SetItems attaches items to the order and computes the line and order
+// totals. Orders without items have no total.
+func (o *Order) SetItems(items []LineItem) {
+	o.Items = items
+	o.Total = 0
+	o.Currency = ""
+	for i := range o.Items {
+		o.Items[i].Total = o.Items[i].Quantity * o.Items[i].UnitPrice
+		o.Total += o.Items[i].Total
+		o.Currency = o.Items[i].Currency
+	}
+}
@@ -0,0 +1,39 @@
+package models
+
+import "testing"
+
+func TestSetItems(t *testing.T) {
+	cases := []struct {
+		name       string
+		items      []LineItem
+		wantTotals []int64
+		want       int64
+		currency   string
+	}{
+		{"no items", nil, nil, 0, ""},
+		{"one item", []LineItem{{Quantity: 3, UnitPrice: 250, Currency: "USD"}}, []int64{750}, 750, "USD"},
+		{"several items", []LineItem{
+			{Quantity: 2, UnitPrice: 500, Currency: "EUR"},
+			{Quantity: 1, UnitPrice: 0, Currency: "EUR"},
+			{Quantity: 10000, UnitPrice: 10000000000, Currency: "EUR"},
+		}, []int64{1000, 0, 100000000000000}, 100000000001000, "EUR"},
+		{"stale totals", []LineItem{{Quantity: 1, UnitPrice: 5, Currency: "USD", Total: 99}}, []int64{5}, 5, "USD"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			//Totals from before are replaced
+			order := Order{Total: 42, Currency: "JPY"}
+			order.SetItems(c.items)
+
+			for i, item := range order.Items {
+				if item.Total != c.wantTotals[i] {
+					t.Errorf("item %d Total = %d, want %d", i, item.Total, c.wantTotals[i])
+				}
+			}
+			if order.Total != c.want || order.Currency != c.currency {
+				t.Errorf("SetItems() order total = %d %s, want %d %s", order.Total, order.Currency, c.want, c.currency)
+			}
+		})
+	}
+}
@@ -3,8 +3,23 @@ package models
 import "time"
 
 type Order struct {
-	Id           int64     `json:"id"`
-	CustomerName string    `json:"CustomerName"`
-	ProductName  string    `json:"ProductName"`
-	OrderDate    time.Time `json:"OrderDate"`
+	Id            int64      `json:"id"`
+	CustomerName  string     `json:"CustomerName" vault:"transit,context=KeyContext"`
+	CustomerIndex string     `json:"-"`
+	KeyContext    string     `json:"-"`
+	CustomerMask  string     `json:"-"`
+	CustomerId    int64      `json:"CustomerId,omitempty"`
+	ProductName   string     `json:"ProductName"`
+	OrderDate     time.Time  `json:"OrderDate"`
+	Status        string     `json:"Status"`
+	Items         []LineItem `json:"Items,omitempty" sql:"-"`
+	Total         int64      `json:"Total,omitempty" sql:"-"`
+	Currency      string     `json:"Currency,omitempty" sql:"-"`
+	Signature     string     `json:"-"`
+	Tampered      bool       `json:"Tampered,omitempty" sql:"-"`
+}
+
+type IntegrityFailure struct {
+	Id     int64  `json:"id"`
+	Reason string `json:"reason"`
 }
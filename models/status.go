@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Order statuses. Delivered and cancelled are final.
+const (
+	StatusCreated   = "created"
+	StatusPaid      = "paid"
+	StatusShipped   = "shipped"
+	StatusDelivered = "delivered"
+	StatusCancelled = "cancelled"
+)
+
+// OrderTransition is one status change in an order's history. From is empty
+// for the transition that created the order.
+type OrderTransition struct {
+	tableName struct{}  `sql:"order_transitions"`
+	Id        int64     `json:"id"`
+	OrderId   int64     `json:"OrderId"`
+	From      string    `json:"From"`
+	To        string    `json:"To"`
+	Actor     string    `json:"Actor"`
+	RequestId string    `json:"RequestId"`
+	Time      time.Time `json:"Time"`
+}
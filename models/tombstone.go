@@ -0,0 +1,9 @@
+package models
+
+import "time"
+
+type Tombstone struct {
+	tableName     struct{}  `sql:"customer_tombstones"`
+	CustomerIndex string    `sql:",pk"`
+	ErasedAt      time.Time `json:"ErasedAt"`
+}
@@ -0,0 +1,41 @@
+package models
+
+import "time"
+
+// Webhook subscribes a URL to order events. No events means every event.
+type Webhook struct {
+	tableName struct{}  `sql:"webhooks"`
+	Id        int64     `json:"id"`
+	Url       string    `json:"Url"`
+	Events    []string  `json:"Events,omitempty" sql:",array"`
+	Active    bool      `json:"Active" sql:",notnull"`
+	CreatedAt time.Time `json:"CreatedAt"`
+}
+
+// WebhookDelivery is an order event queued in the outbox for one webhook
+type WebhookDelivery struct {
+	tableName     struct{} `sql:"webhook_outbox"`
+	Id            int64
+	WebhookId     int64
+	EventId       int64
+	OrderId       int64
+	Type          string
+	Time          time.Time
+	Attempts      int `sql:",notnull"`
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+// DeadLetter is a delivery that ran out of attempts
+type DeadLetter struct {
+	tableName struct{}  `sql:"webhook_dead_letters"`
+	Id        int64     `json:"id"`
+	WebhookId int64     `json:"WebhookId"`
+	EventId   int64     `json:"EventId"`
+	OrderId   int64     `json:"OrderId"`
+	Type      string    `json:"Type"`
+	Time      time.Time `json:"Time"`
+	Attempts  int       `json:"Attempts"`
+	LastError string    `json:"LastError"`
+	FailedAt  time.Time `json:"FailedAt"`
+}
@@ -0,0 +1,158 @@
+// Package openapi serves the API spec and checks incoming requests against it
+// before they reach a handler.
+package openapi
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+)
+
+var unsupported = regexp.MustCompile(`^property "(.*)" is unsupported$`)
+
+//go:embed openapi.json
+var Spec []byte
+
+type Validator struct {
+	router routers.Router
+}
+
+// FieldError is one invalid field or parameter in a rejected request
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// Load parses the embedded spec and fails if it isn't valid OpenAPI
+func Load() (*Validator, error) {
+	loader := openapi3.NewLoader()
+	doc, err := loader.LoadFromData(Spec)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{router: router}, nil
+}
+
+// Handler serves the spec as JSON
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(Spec)
+}
+
+// Middleware rejects requests that don't match their operation in the spec
+// with a 400 listing each invalid field. Routes the spec doesn't describe
+// are passed through.
+func (v *Validator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, params, err := v.router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//Security is enforced by the auth middleware, not here. Streamed
+		//bodies like imports are checked row by row by their handler.
+		err = openapi3filter.ValidateRequest(r.Context(), &openapi3filter.RequestValidationInput{
+			Request:    r,
+			PathParams: params,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				MultiError:         true,
+				AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+				ExcludeRequestBody: !jsonBody(route.Operation),
+			},
+		})
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			respond(w, http.StatusRequestEntityTooLarge, map[string]interface{}{
+				"error": fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit),
+			})
+			return
+		}
+		if err != nil {
+			respond(w, http.StatusBadRequest, map[string]interface{}{
+				"error":  "Invalid request payload",
+				"fields": Fields(err),
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Only JSON bodies are small enough to buffer and check against the spec
+func jsonBody(operation *openapi3.Operation) bool {
+	if operation == nil || operation.RequestBody == nil || operation.RequestBody.Value == nil {
+		return true
+	}
+	return operation.RequestBody.Value.Content.Get("application/json") != nil
+}
+
+// Fields flattens validation errors into one entry per invalid field
+func Fields(err error) []FieldError {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var fields []FieldError
+		for _, inner := range e {
+			fields = append(fields, Fields(inner)...)
+		}
+		return fields
+	case *openapi3filter.RequestError:
+		//Body errors wrap a schema error per field
+		if e.Parameter == nil && e.Err != nil {
+			return Fields(e.Err)
+		}
+		field := "body"
+		if e.Parameter != nil {
+			field = e.Parameter.Name
+		}
+		reason := e.Reason
+		var schemaErr *openapi3.SchemaError
+		if errors.As(e.Err, &schemaErr) {
+			reason = schemaErr.Reason
+		} else if len(reason) == 0 && e.Err != nil {
+			reason = e.Err.Error()
+		}
+		return []FieldError{{Field: field, Reason: reason}}
+	case *openapi3.SchemaError:
+		path := e.JSONPointer()
+		//Unknown properties are reported against their parent object
+		if match := unsupported.FindStringSubmatch(e.Reason); match != nil {
+			path = append(path, match[1])
+		}
+		field := strings.Join(path, ".")
+		if len(field) == 0 {
+			field = "body"
+		}
+		return []FieldError{{Field: field, Reason: e.Reason}}
+	default:
+		return []FieldError{{Field: "body", Reason: err.Error()}}
+	}
+}
+
+func respond(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
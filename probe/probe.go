@@ -0,0 +1,128 @@
+// Package probe runs readiness checks in the background so probes only read
+// the last result and can't be used to drive load at Vault or Postgres.
+package probe
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dimiro1/health"
+	log "github.com/sirupsen/logrus"
+)
+
+// Readiness runs its checkers every Interval. Callers that aren't allowed
+// the details only see each component's status, and the details of a
+// failing check are logged instead.
+type Readiness struct {
+	Interval time.Duration
+	//Called with the overall status whenever it changes
+	Notify func(ready bool)
+
+	mutex    sync.RWMutex
+	names    []string
+	checkers map[string]health.Checker
+	results  map[string]health.Health
+	ready    bool
+}
+
+// AddChecker registers a component. Add them all before Run.
+func (r *Readiness) AddChecker(name string, checker health.Checker) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.checkers == nil {
+		r.checkers = make(map[string]health.Checker)
+	}
+	r.names = append(r.names, name)
+	r.checkers[name] = checker
+}
+
+// Run checks every component now and then every Interval until ctx is done
+func (r *Readiness) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		r.check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready is false until the first round of checks passes
+func (r *Readiness) Ready() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.ready
+}
+
+// Handler serves the last results with a 503 when any check is down. Only
+// callers detailed approves get each check's info.
+func (r *Readiness) Handler(detailed func(req *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.mutex.RLock()
+		ready := r.ready
+		results := r.results
+		r.mutex.RUnlock()
+
+		body := map[string]interface{}{"status": status(ready)}
+		full := detailed(req)
+		for name, h := range results {
+			if full {
+				body[name] = h
+			} else {
+				body[name] = map[string]string{"status": status(h.IsUp())}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(body)
+	})
+}
+
+func (r *Readiness) check() {
+	r.mutex.RLock()
+	names := r.names
+	checkers := r.checkers
+	r.mutex.RUnlock()
+
+	ready := true
+	results := make(map[string]health.Health)
+	for _, name := range names {
+		h := checkers[name].Check()
+		if !h.IsUp() {
+			ready = false
+			log.WithFields(log.Fields{"component": name, "health": h}).Warn("Readiness check failed")
+		}
+		results[name] = h
+	}
+
+	r.mutex.Lock()
+	changed := ready != r.ready || r.results == nil
+	r.results = results
+	r.ready = ready
+	r.mutex.Unlock()
+
+	if changed {
+		log.WithField("ready", ready).Info("Readiness changed")
+		if r.Notify != nil {
+			r.Notify(ready)
+		}
+	}
+}
+
+func status(up bool) string {
+	if up {
+		return "UP"
+	}
+	return "DOWN"
+}
@@ -0,0 +1,378 @@
+// Package rpc serves the order service over gRPC. It shares the service,
+// authenticators, policy and masking with the REST API.
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/auth"
+	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	orderv1 "github.com/lanceplarsen/go-vault-demo/proto/order/v1"
+	"github.com/lanceplarsen/go-vault-demo/service"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+type Server struct {
+	orderv1.UnimplementedOrderServiceServer
+
+	Orders *service.Order
+	//Leave empty to disable authentication
+	Authenticators []auth.Authenticator
+	Policy         *auth.Policy
+	Masking        *auth.Masking
+	//Serve reflection, open to any caller
+	Reflection bool
+	//Largest request message in bytes
+	MaxMessage int
+
+	mutex  sync.Mutex
+	health *health.Server
+	ready  bool
+}
+
+// Operations that let a caller through each method, matching the REST routes.
+// Methods not listed here, like health and reflection, are open.
+var operations = map[string][]string{
+	orderv1.OrderService_ListOrders_FullMethodName:      {auth.ReadMasked, auth.ReadPII},
+	orderv1.OrderService_GetOrder_FullMethodName:        {auth.ReadMasked, auth.ReadPII},
+	orderv1.OrderService_CreateOrder_FullMethodName:     {auth.Create},
+	orderv1.OrderService_UpdateOrder_FullMethodName:     {auth.Update},
+	orderv1.OrderService_DeleteOrder_FullMethodName:     {auth.Delete},
+	orderv1.OrderService_RestoreOrder_FullMethodName:    {auth.Delete},
+	orderv1.OrderService_TransitionOrder_FullMethodName: {auth.Update},
+	orderv1.OrderService_ListTransitions_FullMethodName: {auth.ReadMasked, auth.ReadPII},
+}
+
+// Masking route the read methods share with GET /api/orders
+const ordersRoute = "orders"
+
+// GRPC builds a grpc.Server with the order, health and reflection services.
+// Pass the listener TLS config to serve gRPC over TLS.
+func (s *Server) GRPC(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(s.unaryInterceptor),
+		grpc.ChainStreamInterceptor(s.streamInterceptor),
+	}
+	if s.MaxMessage > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(s.MaxMessage))
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+
+	orderv1.RegisterOrderServiceServer(server, s)
+
+	s.mutex.Lock()
+	s.health = health.NewServer()
+	s.setServing()
+	s.mutex.Unlock()
+	healthpb.RegisterHealthServer(server, s.health)
+
+	if s.Reflection {
+		reflection.Register(server)
+	}
+
+	return server
+}
+
+// SetReady reports serving while the readiness checks pass. It can be
+// called before the server is built.
+func (s *Server) SetReady(ready bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.ready = ready
+	if s.health != nil {
+		s.setServing()
+	}
+}
+
+// Callers must hold the mutex
+func (s *Server) setServing() {
+	serving := healthpb.HealthCheckResponse_NOT_SERVING
+	if s.ready {
+		serving = healthpb.HealthCheckResponse_SERVING
+	}
+	s.health.SetServingStatus("", serving)
+	s.health.SetServingStatus(orderv1.OrderService_ServiceDesc.ServiceName, serving)
+}
+
+// Shutdown reports not serving for good so clients drain before the server
+// stops
+func (s *Server) Shutdown() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.health != nil {
+		s.health.Shutdown()
+	}
+}
+
+func (s *Server) ListOrders(req *orderv1.ListOrdersRequest, stream orderv1.OrderService_ListOrdersServer) error {
+	var orders []models.Order
+	var err error
+
+	ctx := stream.Context()
+	if len(req.Customer) > 0 {
+		orders, err = s.Orders.GetOrdersByCustomer(ctx, req.Customer, s.view(ctx))
+	} else {
+		orders, err = s.Orders.GetOrders(ctx, s.view(ctx))
+	}
+	if err != nil {
+		return toStatus(err)
+	}
+
+	for _, order := range orders {
+		if err := stream.Send(toProto(order)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) GetOrder(ctx context.Context, req *orderv1.GetOrderRequest) (*orderv1.Order, error) {
+	order, err := s.Orders.GetOrder(ctx, req.Id, s.view(ctx))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(order), nil
+}
+
+func (s *Server) CreateOrder(ctx context.Context, req *orderv1.CreateOrderRequest) (*orderv1.Order, error) {
+	var order models.Order
+	var err error
+
+	//Retries with the same key get the first response back
+	order = models.Order{
+		CustomerName: req.CustomerName,
+		CustomerId:   req.CustomerId,
+		ProductName:  req.ProductName,
+		Items:        fromProtoItems(req.Items),
+	}
+	if key := metadataValue(ctx, "idempotency-key"); len(key) > 0 {
+		order, _, err = s.Orders.CreateOrderOnce(ctx, key, order)
+	} else {
+		order, err = s.Orders.CreateOrder(ctx, order)
+	}
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(order), nil
+}
+
+func (s *Server) UpdateOrder(ctx context.Context, req *orderv1.UpdateOrderRequest) (*orderv1.Order, error) {
+	order, err := s.Orders.UpdateOrder(ctx, models.Order{
+		Id:           req.Id,
+		CustomerName: req.CustomerName,
+		CustomerId:   req.CustomerId,
+		ProductName:  req.ProductName,
+		Items:        fromProtoItems(req.Items),
+	})
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(order), nil
+}
+
+func (s *Server) DeleteOrder(ctx context.Context, req *orderv1.DeleteOrderRequest) (*orderv1.DeleteOrderResponse, error) {
+	if err := s.Orders.DeleteOrder(ctx, req.Id); err != nil {
+		return nil, toStatus(err)
+	}
+	return &orderv1.DeleteOrderResponse{}, nil
+}
+
+func (s *Server) RestoreOrder(ctx context.Context, req *orderv1.RestoreOrderRequest) (*orderv1.Order, error) {
+	order, err := s.Orders.RestoreOrder(ctx, req.Id, s.view(ctx))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProto(order), nil
+}
+
+func (s *Server) TransitionOrder(ctx context.Context, req *orderv1.TransitionOrderRequest) (*orderv1.Transition, error) {
+	transition, err := s.Orders.TransitionOrder(ctx, req.Id, req.Status)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return toProtoTransition(transition), nil
+}
+
+func (s *Server) ListTransitions(ctx context.Context, req *orderv1.ListTransitionsRequest) (*orderv1.ListTransitionsResponse, error) {
+	transitions, err := s.Orders.OrderHistory(ctx, req.Id)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &orderv1.ListTransitionsResponse{}
+	for _, transition := range transitions {
+		resp.Transitions = append(resp.Transitions, toProtoTransition(transition))
+	}
+	return resp, nil
+}
+
+func (s *Server) view(ctx context.Context) service.View {
+	if s.Masking == nil {
+		return service.Clear
+	}
+	return service.View(s.Masking.ViewFor(auth.FromContext(ctx), ordersRoute))
+}
+
+func (s *Server) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authorize(requestID(ctx), info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *Server) streamInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authorize(requestID(stream.Context()), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// Identify the caller the same way the REST middleware does and check the
+// method's operations against the policy
+func (s *Server) authorize(ctx context.Context, fullMethod string) (context.Context, error) {
+	ops, ok := operations[fullMethod]
+	if !ok || len(s.Authenticators) == 0 {
+		return ctx, nil
+	}
+
+	identity, err := auth.Authenticate(auth.GRPCRequest(ctx, fullMethod), s.Authenticators...)
+	if err == auth.ErrNoCredentials {
+		return ctx, status.Error(codes.Unauthenticated, "Authentication required")
+	}
+	if err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "Invalid credentials")
+	}
+
+	for _, op := range ops {
+		if s.Policy.Allowed(identity, op) {
+			return auth.WithIdentity(ctx, identity), nil
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"method":      fullMethod,
+		"auth_method": identity.Method,
+		"caller":      identity.Name,
+	}).Warn("Denied request")
+	return ctx, status.Error(codes.PermissionDenied, "Forbidden")
+}
+
+// Tag the call with the caller's x-request-id or a new one
+func requestID(ctx context.Context) context.Context {
+	return audit.WithRequestID(ctx, audit.NewRequestID(metadataValue(ctx, "x-request-id")))
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(key); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Streams carry their own context so swap in the authorized one
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+func toStatus(err error) error {
+	var invalid *service.ValidationError
+	if errors.As(err, &invalid) {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	switch err {
+	case dao.ErrNotFound, dao.ErrCustomerNotFound:
+		return status.Error(codes.NotFound, err.Error())
+	case dao.ErrConflict:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case dao.ErrInvalid:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case dao.ErrUnavailable:
+		return status.Error(codes.Unavailable, err.Error())
+	case service.ErrKeyReused, service.ErrKeyInFlight:
+		return status.Error(codes.AlreadyExists, err.Error())
+	case service.ErrTampered, service.ErrInvalidTransition, service.ErrOrderClosed, dao.ErrCustomerInUse:
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func toProto(order models.Order) *orderv1.Order {
+	pb := &orderv1.Order{
+		Id:           order.Id,
+		CustomerName: order.CustomerName,
+		ProductName:  order.ProductName,
+		OrderDate:    timestamppb.New(order.OrderDate),
+		Tampered:     order.Tampered,
+		Status:       order.Status,
+		Total:        order.Total,
+		Currency:     order.Currency,
+		CustomerId:   order.CustomerId,
+	}
+	for _, item := range order.Items {
+		pb.Items = append(pb.Items, &orderv1.LineItem{
+			Sku:       item.Sku,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Currency:  item.Currency,
+			Total:     item.Total,
+		})
+	}
+	return pb
+}
+
+// Totals are computed by the service so the caller's are dropped
+func fromProtoItems(items []*orderv1.LineItem) []models.LineItem {
+	var converted []models.LineItem
+	for _, item := range items {
+		converted = append(converted, models.LineItem{
+			Sku:       item.Sku,
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Currency:  item.Currency,
+		})
+	}
+	return converted
+}
+
+func toProtoTransition(transition models.OrderTransition) *orderv1.Transition {
+	return &orderv1.Transition{
+		Id:        transition.Id,
+		OrderId:   transition.OrderId,
+		From:      transition.From,
+		To:        transition.To,
+		Actor:     transition.Actor,
+		RequestId: transition.RequestId,
+		Time:      timestamppb.New(transition.Time),
+	}
+}
@@ -1,6 +1,219 @@
-CREATE TABLE orders (
+-- Safe to run again: it creates what's missing and upgrades a database from
+-- an earlier release in place.
+
+CREATE TABLE IF NOT EXISTS customers (
     id bigserial primary key,
-    customer_name varchar(120) NOT NULL,
+    name text NOT NULL,
+    email text NOT NULL,
+    phone text,
+    shipping_address text,
+    customer_index varchar(120) NOT NULL,
+    -- Random derivation context for the contact details. Customers from
+    -- before it was added derive from customer_index.
+    key_context varchar(64),
+    name_mask varchar(120) NOT NULL,
+    email_index varchar(120) NOT NULL UNIQUE,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS customers_customer_index_idx ON customers (customer_index);
+
+CREATE TABLE IF NOT EXISTS orders (
+    id bigserial primary key,
+    customer_name text NOT NULL,
     product_name varchar(20) NOT NULL,
     order_date timestamp NOT NULL
 );
+
+-- Columns added since the first release. Existing rows are brought up to
+-- date by the backfill the app runs at startup.
+ALTER TABLE orders ALTER COLUMN customer_name TYPE text;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_index varchar(120);
+-- Random derivation context for the customer name, tombstoned when the
+-- order is shredded. Orders from before it was added derive from
+-- customer_index, or were encrypted under the legacy key without one.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS key_context varchar(64);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_mask varchar(120);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS customer_id bigint REFERENCES customers (id);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS status varchar(20) NOT NULL DEFAULT 'created'
+    CHECK (status IN ('created', 'paid', 'shipped', 'delivered', 'cancelled'));
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS signature text;
+-- Soft deletes. Purged rows were shredded and can't be restored.
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS deleted_at timestamp;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS purged_at timestamp;
+
+CREATE INDEX IF NOT EXISTS orders_customer_index_idx ON orders (customer_index);
+CREATE INDEX IF NOT EXISTS orders_customer_id_idx ON orders (customer_id);
+CREATE INDEX IF NOT EXISTS orders_deleted_at_idx ON orders (deleted_at) WHERE deleted_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS order_items (
+    id bigserial primary key,
+    order_id bigint NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    sku varchar(40) NOT NULL,
+    quantity bigint NOT NULL CHECK (quantity > 0),
+    unit_price bigint NOT NULL CHECK (unit_price >= 0),
+    currency char(3) NOT NULL,
+    total bigint NOT NULL,
+    CHECK (total = quantity * unit_price)
+);
+
+CREATE INDEX IF NOT EXISTS order_items_order_id_idx ON order_items (order_id);
+
+CREATE TABLE IF NOT EXISTS order_transitions (
+    id bigserial primary key,
+    order_id bigint NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    "from" varchar(20) NOT NULL,
+    "to" varchar(20) NOT NULL,
+    actor varchar(120) NOT NULL,
+    request_id varchar(64) NOT NULL,
+    time timestamp NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS order_transitions_order_id_idx ON order_transitions (order_id);
+
+-- Change feed for the event stream. The trigger records each change and
+-- notifies listeners with its id, never the row, so no PII goes over NOTIFY.
+-- Ids are taken before commit, so readers page by position instead, which
+-- the app hands out to events once they have committed.
+CREATE TABLE IF NOT EXISTS order_events (
+    id bigserial primary key,
+    order_id bigint NOT NULL,
+    type varchar(20) NOT NULL,
+    time timestamp NOT NULL
+);
+
+ALTER TABLE order_events DROP COLUMN IF EXISTS txid;
+ALTER TABLE order_events ADD COLUMN IF NOT EXISTS position bigint;
+
+CREATE SEQUENCE IF NOT EXISTS order_events_position_seq;
+CREATE INDEX IF NOT EXISTS order_events_time_idx ON order_events (time);
+CREATE UNIQUE INDEX IF NOT EXISTS order_events_position_idx ON order_events (position);
+CREATE INDEX IF NOT EXISTS order_events_unpositioned_idx ON order_events (id) WHERE position IS NULL;
+
+-- Webhook subscriptions. No events means every event.
+CREATE TABLE IF NOT EXISTS webhooks (
+    id bigserial primary key,
+    url text NOT NULL,
+    events varchar(20)[],
+    active boolean NOT NULL,
+    created_at timestamp NOT NULL
+);
+
+-- Transactional outbox. The orders trigger queues a delivery for each
+-- subscribed webhook in the same transaction as the change.
+CREATE TABLE IF NOT EXISTS webhook_outbox (
+    id bigserial primary key,
+    webhook_id bigint NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id bigint NOT NULL,
+    order_id bigint NOT NULL,
+    type varchar(20) NOT NULL,
+    time timestamp NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    next_attempt_at timestamp NOT NULL,
+    last_error text
+);
+
+CREATE INDEX IF NOT EXISTS webhook_outbox_next_attempt_at_idx ON webhook_outbox (next_attempt_at);
+
+-- Deliveries that ran out of attempts, kept until they are retried
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id bigint primary key,
+    webhook_id bigint NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+    event_id bigint NOT NULL,
+    order_id bigint NOT NULL,
+    type varchar(20) NOT NULL,
+    time timestamp NOT NULL,
+    attempts integer NOT NULL,
+    last_error text,
+    failed_at timestamp NOT NULL
+);
+
+CREATE OR REPLACE FUNCTION order_events_notify() RETURNS trigger AS $$
+DECLARE
+    event_id bigint;
+    event_type varchar(20);
+    event_order bigint;
+    event_time timestamp := now() AT TIME ZONE 'utc';
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        event_type := 'created';
+        event_order := NEW.id;
+    ELSIF TG_OP = 'UPDATE' THEN
+        -- Changes to deleted orders, like shredding them, aren't announced
+        IF OLD.deleted_at IS NOT NULL AND NEW.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+        -- Nor is the startup backfill, which marks its transactions, or
+        -- anything else that only touches the index, mask or signature
+        IF current_setting('app.backfill', true) = 'on' THEN
+            RETURN NULL;
+        END IF;
+        IF to_jsonb(OLD) - 'customer_index' - 'customer_mask' - 'signature' =
+           to_jsonb(NEW) - 'customer_index' - 'customer_mask' - 'signature' THEN
+            RETURN NULL;
+        END IF;
+        IF NEW.deleted_at IS NOT NULL THEN
+            event_type := 'deleted';
+        ELSIF OLD.deleted_at IS NOT NULL THEN
+            event_type := 'restored';
+        ELSE
+            event_type := 'updated';
+        END IF;
+        event_order := NEW.id;
+    ELSE
+        -- Soft deleted orders were announced when they were deleted
+        IF OLD.deleted_at IS NOT NULL THEN
+            RETURN NULL;
+        END IF;
+        event_type := 'deleted';
+        event_order := OLD.id;
+    END IF;
+
+    INSERT INTO order_events (order_id, type, time) VALUES (event_order, event_type, event_time) RETURNING id INTO event_id;
+
+    INSERT INTO webhook_outbox (webhook_id, event_id, order_id, type, time, next_attempt_at)
+    SELECT id, event_id, event_order, event_type, event_time, event_time FROM webhooks
+    WHERE active AND (events IS NULL OR cardinality(events) = 0 OR event_type = ANY (events));
+
+    PERFORM pg_notify('order_events', event_id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS orders_events ON orders;
+CREATE TRIGGER orders_events AFTER INSERT OR UPDATE OR DELETE ON orders
+    FOR EACH ROW EXECUTE PROCEDURE order_events_notify();
+
+-- Keyed by the erased derivation context: a customer name index, or a
+-- customer's own key context
+CREATE TABLE IF NOT EXISTS customer_tombstones (
+    customer_index varchar(120) primary key,
+    erased_at timestamp NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    seq bigint primary key,
+    time timestamp NOT NULL,
+    action varchar(20) NOT NULL,
+    caller varchar(120) NOT NULL,
+    method varchar(20) NOT NULL,
+    request_id varchar(64) NOT NULL,
+    order_ids bigint[] NOT NULL,
+    prev text NOT NULL,
+    hmac text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    caller varchar(120) NOT NULL,
+    key varchar(255) NOT NULL,
+    fingerprint text NOT NULL,
+    order_id bigint NOT NULL DEFAULT 0,
+    customer_index varchar(120),
+    response text,
+    created_at timestamp NOT NULL,
+    expires_at timestamp NOT NULL,
+    PRIMARY KEY (caller, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
@@ -0,0 +1,8 @@
+#!/bin/bash
+
+#Regenerate the gRPC code. Needs protoc, protoc-gen-go and protoc-gen-go-grpc on the PATH
+cd "$(dirname "$0")/.."
+protoc \
+  --go_out=. --go_opt=paths=source_relative \
+  --go-grpc_out=. --go-grpc_opt=paths=source_relative \
+  proto/order/v1/order.proto
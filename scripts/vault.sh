@@ -2,16 +2,54 @@
 
 #*****Policy*****
 
-echo 'path "transit/decrypt/order" {
+echo 'path "transit/decrypt/order-derived" {
   capabilities = ["update"]
 }
-path "transit/encrypt/order" {
+path "transit/encrypt/order-derived" {
+  capabilities = ["update"]
+}
+path "transit/hmac/order-derived" {
+  capabilities = ["update"]
+}
+path "transit/datakey/plaintext/order-derived" {
+  capabilities = ["update"]
+}
+path "transit/decrypt/order" {
+  capabilities = ["update"]
+}
+path "transit/sign/order-signing" {
+  capabilities = ["update"]
+}
+path "transit/verify/order-signing" {
   capabilities = ["update"]
 }
 path "database/creds/order" {
   capabilities = ["read"]
+}
+path "transit/hmac/audit" {
+  capabilities = ["update"]
+}
+path "transit/verify/audit" {
+  capabilities = ["update"]
+}
+path "transit/hmac/webhook" {
+  capabilities = ["update"]
+}
+path "auth/token/lookup" {
+  capabilities = ["update"]
+}
+path "identity/entity/id/*" {
+  capabilities = ["read"]
+}
+path "pki/issue/order" {
+  capabilities = ["update"]
 }' | vault policy write order -
 
+#Webhook receivers only need to check signatures
+echo 'path "transit/verify/webhook" {
+  capabilities = ["update"]
+}' | vault policy write webhook-receiver -
+
 #*****Postgres Confg*****
 
 #Mount DB backend
@@ -35,5 +73,32 @@ vault write database/roles/order \
 #Mount transit backend
 vault secrets enable transit
 
-#Create transit key
-vault write -f transit/keys/order
+#Create transit key. Customer data is encrypted under a key derived per record.
+#Earlier releases used the non-derived order key, which the app can still
+#decrypt with as its legacy-key while it re-encrypts those rows.
+vault write transit/keys/order-derived derived=true
+
+#Create the audit chain key
+vault write -f transit/keys/audit
+
+#Create the webhook signing key
+vault write -f transit/keys/webhook
+
+#Create the order signing key
+vault write transit/keys/order-signing type=ed25519
+
+#*****PKI Confg*****
+
+#Mount PKI backend for the TLS listener certificate
+vault secrets enable pki
+vault secrets tune -max-lease-ttl=8760h pki
+
+#Create a root CA
+vault write pki/root/generate/internal common_name="go-vault-demo" ttl=8760h
+
+#Create the order role for listener certificates
+vault write pki/roles/order \
+  allowed_domains="localhost" \
+  allow_localhost=true \
+  allow_subdomains=true \
+  max_ttl="72h"
@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/bulk"
+	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+// Number of orders imported or exported per transit and database round trip
+const bulkBatch = 100
+
+// Most rejected rows an import error lists
+const maxRowErrors = 100
+
+// RowError is one rejected import row, by its line in the input
+type RowError struct {
+	Line   int          `json:"line"`
+	Reason string       `json:"reason,omitempty"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// ImportError is returned when any import row is invalid. Nothing from the
+// import is written.
+type ImportError struct {
+	Rows []RowError
+	//Rejected rows, including ones past the listed ones
+	Invalid int
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("Import rejected with %d invalid rows.", e.Invalid)
+}
+
+func (e *ImportError) add(row RowError) {
+	e.Invalid++
+	if len(e.Rows) < maxRowErrors {
+		e.Rows = append(e.Rows, row)
+	}
+}
+
+// ImportOrders checks every row and writes them all in one transaction, or
+// none of them if any row is invalid. Rows are encrypted, indexed and signed
+// in transit batches as they are read. Rows may carry their original order
+// date and status.
+func (o *Order) ImportOrders(ctx context.Context, rows bulk.Reader) (int, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.ImportOrders")
+	defer span.End()
+
+	var count int
+	rejected := &ImportError{}
+
+	err := o.Dao.Import(ctx, func(batch *dao.Batch) error {
+		var pending []models.Order
+
+		for {
+			order, err := rows.Read()
+			if err == io.EOF {
+				break
+			}
+			var rowErr *bulk.RowError
+			if errors.As(err, &rowErr) {
+				rejected.add(RowError{Line: rows.Line(), Reason: rowErr.Reason})
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			order, invalid := o.importable(order)
+			if invalid != nil {
+				rejected.add(RowError{Line: rows.Line(), Fields: invalid.Fields})
+				continue
+			}
+
+			//Once a row is rejected nothing gets written, so just keep checking
+			if rejected.Invalid > 0 {
+				continue
+			}
+			pending = append(pending, order)
+			if len(pending) == bulkBatch {
+				if err := o.importBatch(ctx, batch, pending); err != nil {
+					return err
+				}
+				count += len(pending)
+				pending = nil
+			}
+		}
+
+		if rejected.Invalid > 0 {
+			return rejected
+		}
+		if err := o.importBatch(ctx, batch, pending); err != nil {
+			return err
+		}
+		count += len(pending)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	logger(ctx).WithField("imported", count).Info("Order import complete")
+	return count, nil
+}
+
+// ExportOrders pages through every order by id and hands each page to fn in
+// the caller's view, so the table is never held in memory at once
+func (o *Order) ExportOrders(ctx context.Context, view View, fn func([]models.Order) error) (int, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.ExportOrders")
+	defer span.End()
+
+	var last int64
+	var count int
+
+	for {
+		page, err := o.Dao.FindAfter(ctx, last, bulkBatch)
+		if err != nil {
+			return count, err
+		}
+		if len(page) == 0 {
+			return count, nil
+		}
+
+		orders, err := o.readOrders(ctx, page, view)
+		if err != nil {
+			return count, err
+		}
+		if err := fn(orders); err != nil {
+			return count, err
+		}
+		count += len(orders)
+
+		last = page[len(page)-1].Id
+	}
+}
+
+// Normalize an import row and fill in the defaults for a new order
+func (o *Order) importable(order models.Order) (models.Order, *ValidationError) {
+	order = normalize(order)
+
+	invalid, _ := o.validate(order).(*ValidationError)
+	if invalid == nil {
+		invalid = &ValidationError{}
+	}
+
+	if len(order.Status) == 0 {
+		order.Status = models.StatusCreated
+	}
+	if _, ok := transitions[order.Status]; !ok {
+		invalid.add("Status", "must be one of created, paid, shipped, delivered or cancelled")
+	}
+
+	if order.OrderDate.IsZero() {
+		order.OrderDate = time.Now()
+	}
+	order.OrderDate = order.OrderDate.UTC().Truncate(time.Microsecond)
+
+	if len(invalid.Fields) > 0 {
+		return order, invalid
+	}
+	return order, nil
+}
+
+// Seal a batch of orders with one transit call per step and insert them
+func (o *Order) importBatch(ctx context.Context, batch *dao.Batch, orders []models.Order) error {
+	var names []string
+	var ids []int64
+	var created []models.OrderTransition
+
+	if len(orders) == 0 {
+		return nil
+	}
+
+	reserved, err := o.Dao.NextIds(ctx, len(orders))
+	if err != nil {
+		return err
+	}
+
+	for _, order := range orders {
+		names = append(names, normalizeCustomer(order.CustomerName))
+	}
+	indexes, err := o.hmacBatch(ctx, names)
+	if err != nil {
+		return err
+	}
+
+	for i := range orders {
+		orders[i].Id = reserved[i]
+		orders[i].CustomerIndex = indexes[i]
+		orders[i].CustomerMask = maskCustomer(orders[i].CustomerName)
+		orders[i].KeyContext, err = newKeyContext()
+		if err != nil {
+			return err
+		}
+		ids = append(ids, reserved[i])
+	}
+
+	if err := o.Encyrption.Encrypt(ctx, orders); err != nil {
+		return err
+	}
+	if err := o.audit(ctx, audit.Encrypt, ids); err != nil {
+		return err
+	}
+	if err := o.signBatch(ctx, orders); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, order := range orders {
+		created = append(created, models.OrderTransition{
+			OrderId:   order.Id,
+			To:        order.Status,
+			Actor:     callerName(ctx),
+			RequestId: audit.RequestIDFromContext(ctx),
+			Time:      now,
+		})
+	}
+
+	return batch.Insert(orders, created)
+}
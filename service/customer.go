@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+// Customer keeps customer contact details. It shares Vault, transit, the
+// audit log and tombstones with the order service.
+type Customer struct {
+	Orders *Order
+	Dao    *dao.Customer
+}
+
+func (c *Customer) GetCustomers(ctx context.Context, view View) ([]models.Customer, error) {
+	ctx, span := tracing.Start(ctx, "service.Customer.GetCustomers")
+	defer span.End()
+
+	eCustomers, err := c.Dao.FindAll(ctx)
+	if err != nil {
+		return []models.Customer{}, err
+	}
+	return c.readCustomers(ctx, eCustomers, view)
+}
+
+func (c *Customer) GetCustomer(ctx context.Context, id int64, view View) (models.Customer, error) {
+	ctx, span := tracing.Start(ctx, "service.Customer.GetCustomer")
+	defer span.End()
+
+	eCustomer, err := c.Dao.FindById(ctx, id)
+	if err != nil {
+		return eCustomer, err
+	}
+
+	customers, err := c.readCustomers(ctx, []models.Customer{eCustomer}, view)
+	if err != nil {
+		return eCustomer, err
+	}
+	if len(customers) == 0 {
+		return eCustomer, dao.ErrCustomerNotFound
+	}
+	return customers[0], nil
+}
+
+func (c *Customer) CreateCustomer(ctx context.Context, customer models.Customer) (models.Customer, error) {
+	ctx, span := tracing.Start(ctx, "service.Customer.CreateCustomer")
+	defer span.End()
+
+	customer = normalizeContact(customer)
+	if err := c.validate(customer); err != nil {
+		return customer, err
+	}
+
+	//Reserve the id up front so the encryption is audited before the insert
+	id, err := c.Dao.NextId(ctx)
+	if err != nil {
+		return customer, err
+	}
+	customer.Id = id
+	customer.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	customer.UpdatedAt = customer.CreatedAt
+
+	//Keep the unencrypted fields to send back to the API
+	plain := customer
+
+	if err := c.seal(ctx, &customer); err != nil {
+		return plain, err
+	}
+	if _, err := c.Dao.Insert(ctx, customer); err != nil {
+		return plain, err
+	}
+
+	return plain, nil
+}
+
+// UpdateCustomer replaces a customer's contact details. A new name moves the
+// customer's orders to the new blind index, so they are re-signed with it.
+func (c *Customer) UpdateCustomer(ctx context.Context, customer models.Customer) (models.Customer, error) {
+	ctx, span := tracing.Start(ctx, "service.Customer.UpdateCustomer")
+	defer span.End()
+
+	customer = normalizeContact(customer)
+	if err := c.validate(customer); err != nil {
+		return customer, err
+	}
+
+	existing, err := c.GetCustomer(ctx, customer.Id, Ciphertext)
+	if err != nil {
+		return customer, err
+	}
+	customer.CreatedAt = existing.CreatedAt
+	customer.KeyContext = existing.KeyContext
+	customer.UpdatedAt = time.Now().UTC().Truncate(time.Microsecond)
+
+	plain := customer
+
+	if err := c.seal(ctx, &customer); err != nil {
+		return plain, err
+	}
+
+	var orders []models.Order
+	if customer.CustomerIndex != existing.CustomerIndex {
+		orders, err = c.reindexOrders(ctx, customer)
+		if err != nil {
+			return plain, err
+		}
+	}
+	if err := c.Dao.Update(ctx, customer, orders); err != nil {
+		return plain, err
+	}
+
+	return plain, nil
+}
+
+// DeleteCustomer fails while orders still reference the customer. Erase the
+// customer to remove both.
+func (c *Customer) DeleteCustomer(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "service.Customer.DeleteCustomer")
+	defer span.End()
+
+	if err := c.Dao.Delete(ctx, id); err != nil {
+		return err
+	}
+	return c.Orders.audit(ctx, audit.CustomerDelete, []int64{id})
+}
+
+// EraseCustomer deletes a customer and the orders that reference it, and
+// tombstones its key context so contact details restored from a backup are
+// never decrypted again. Other customers with the same name are untouched.
+func (c *Customer) EraseCustomer(ctx context.Context, id int64) (int, error) {
+	ctx, span := tracing.Start(ctx, "service.Customer.EraseCustomer")
+	defer span.End()
+
+	customer, err := c.Dao.FindById(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := c.Orders.Tombstones.EraseCustomer(ctx, id, keyContext(customer), time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	if err := c.Orders.audit(ctx, audit.CustomerDelete, []int64{id}); err != nil {
+		return len(ids), err
+	}
+	return len(ids), c.Orders.audit(ctx, audit.Erase, ids)
+}
+
+// Index, mask and encrypt a customer into its stored form. New customers
+// get a random key context, and customers from before key contexts get one
+// as they are re-encrypted.
+func (c *Customer) seal(ctx context.Context, customer *models.Customer) error {
+	index, err := c.Orders.CustomerIndex(ctx, customer.Name)
+	if err != nil {
+		return err
+	}
+	customer.CustomerIndex = index
+	customer.NameMask = maskCustomer(customer.Name)
+
+	if len(customer.KeyContext) == 0 {
+		customer.KeyContext, err = newKeyContext()
+		if err != nil {
+			return err
+		}
+	}
+
+	//Emails are unique so the same person isn't stored twice
+	customer.EmailIndex, err = c.Orders.hmac(ctx, "email:"+strings.ToLower(customer.Email))
+	if err != nil {
+		return err
+	}
+
+	if err := c.Orders.Encyrption.Encrypt(ctx, customer); err != nil {
+		return err
+	}
+	return c.Orders.audit(ctx, audit.CustomerEncrypt, []int64{customer.Id})
+}
+
+// Point the customer's orders at its new index and re-sign them
+func (c *Customer) reindexOrders(ctx context.Context, customer models.Customer) ([]models.Order, error) {
+	orders, err := c.Orders.Dao.FindByCustomerId(ctx, customer.Id)
+	if err != nil {
+		return orders, err
+	}
+
+	//Don't re-sign orders that were changed behind our back
+	valid, err := c.Orders.verify(ctx, orders)
+	if err != nil {
+		return orders, err
+	}
+	for i := range orders {
+		if !valid[i] {
+			return orders, ErrTampered
+		}
+		orders[i].CustomerIndex = customer.CustomerIndex
+		orders[i].CustomerMask = customer.NameMask
+		if err := c.Orders.sign(ctx, &orders[i]); err != nil {
+			return orders, err
+		}
+	}
+
+	return orders, nil
+}
+
+// Only decrypt contact details for callers allowed to see the clear text
+func (c *Customer) readCustomers(ctx context.Context, eCustomers []models.Customer, view View) ([]models.Customer, error) {
+	eCustomers, err := c.withoutErased(ctx, eCustomers)
+	if err != nil {
+		return []models.Customer{}, err
+	}
+
+	switch view {
+	case Clear:
+		return c.decryptCustomers(ctx, eCustomers)
+	case Masked:
+		for i := range eCustomers {
+			eCustomers[i].Name = eCustomers[i].NameMask
+			eCustomers[i].Email = maskContact(eCustomers[i].Email)
+			eCustomers[i].Phone = maskContact(eCustomers[i].Phone)
+			eCustomers[i].ShippingAddress = maskContact(eCustomers[i].ShippingAddress)
+		}
+	}
+
+	return eCustomers, nil
+}
+
+func (c *Customer) decryptCustomers(ctx context.Context, eCustomers []models.Customer) ([]models.Customer, error) {
+	var dCustomers []models.Customer
+	var ids []int64
+
+	for i := range eCustomers {
+		eCustomers[i].KeyContext = keyContext(eCustomers[i])
+	}
+	failed, err := c.Orders.Encyrption.Decrypt(ctx, eCustomers)
+	if err != nil {
+		return []models.Customer{}, err
+	}
+
+	for i, customer := range eCustomers {
+		if failed[i] != nil {
+			logger(ctx).WithField("customer_id", customer.Id).WithError(failed[i]).Warn("Unable to decrypt customer")
+			continue
+		}
+		dCustomers = append(dCustomers, customer)
+		ids = append(ids, customer.Id)
+	}
+
+	//Don't hand out plaintext we couldn't account for
+	if len(ids) > 0 {
+		if err := c.Orders.audit(ctx, audit.CustomerDecrypt, ids); err != nil {
+			return []models.Customer{}, err
+		}
+	}
+
+	return dCustomers, nil
+}
+
+// Drop customers restored from a backup after they were erased
+func (c *Customer) withoutErased(ctx context.Context, eCustomers []models.Customer) ([]models.Customer, error) {
+	var indexes []string
+	var live []models.Customer
+
+	for _, customer := range eCustomers {
+		indexes = append(indexes, keyContext(customer))
+	}
+
+	erased, err := c.Orders.Tombstones.FindByCustomerIndexes(ctx, indexes)
+	if err != nil {
+		return live, err
+	}
+
+	for _, customer := range eCustomers {
+		if erasedAt, ok := erased[keyContext(customer)]; ok && !customer.CreatedAt.After(erasedAt) {
+			logger(ctx).WithField("customer_id", customer.Id).Info("Refusing to read erased customer")
+			continue
+		}
+		live = append(live, customer)
+	}
+
+	return live, nil
+}
+
+// Customers from before key contexts were derived from their name index
+func keyContext(customer models.Customer) string {
+	if len(customer.KeyContext) == 0 {
+		return customer.CustomerIndex
+	}
+	return customer.KeyContext
+}
+
+func normalizeContact(customer models.Customer) models.Customer {
+	customer.Name = strings.TrimSpace(customer.Name)
+	customer.Email = strings.TrimSpace(customer.Email)
+	customer.Phone = strings.TrimSpace(customer.Phone)
+	customer.ShippingAddress = strings.TrimSpace(customer.ShippingAddress)
+	return customer
+}
+
+// Contact details have no stored mask, so only say whether one is set
+func maskContact(value string) string {
+	if len(value) == 0 {
+		return ""
+	}
+	return "***"
+}
@@ -0,0 +1,197 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	log "github.com/sirupsen/logrus"
+)
+
+// Events fans the order change feed out to subscribers. One Postgres
+// connection listens for all of them and each reads the feed past its own
+// cursor, so a slow subscriber only falls behind itself.
+type Events struct {
+	Orders *Order
+	Dao    *dao.Event
+	//How often subscribers check for events a lost notification didn't announce
+	Poll time.Duration
+	//How long events are kept for subscribers to resume from
+	Retention time.Duration
+
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+// Number of events a subscriber reads and renders at a time
+const eventBatch = 100
+
+// How long to wait before listening again after the listener stops
+const relistenDelay = 5 * time.Second
+
+// Listen positions newly committed events and wakes subscribers on each
+// notification, and every poll in case one was missed, until ctx is done
+func (e *Events) Listen(ctx context.Context) {
+	ticker := time.NewTicker(e.Poll)
+	defer ticker.Stop()
+
+	notified := e.Dao.Listen(ctx)
+	var relisten <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-notified:
+			if !ok {
+				notified, relisten = nil, time.After(relistenDelay)
+				continue
+			}
+		case <-relisten:
+			notified, relisten = e.Dao.Listen(ctx), nil
+			continue
+		case <-ticker.C:
+		}
+
+		//Another instance may have positioned them already, so wake either way
+		if _, err := e.Dao.Sequence(ctx); err != nil && ctx.Err() == nil {
+			log.WithError(err).Error("Order event sequencing failed")
+		}
+		e.broadcast()
+	}
+}
+
+// Subscribe calls fn with each batch of events after the given id, with the
+// orders they touched as the view allows. Pass a negative id to start from
+// now. Events come in the order they committed, which isn't always id
+// order. fn is also
+// called with no events every poll so the caller can keep its connection
+// alive. It returns when ctx is done or fn fails.
+func (e *Events) Subscribe(ctx context.Context, id int64, view View, fn func(events []models.OrderEvent) error) error {
+	var after int64
+	var err error
+
+	//Listen before finding our place so nothing lands in between
+	wake := e.subscribe()
+	defer e.unsubscribe(wake)
+
+	if id < 0 {
+		after, err = e.Dao.Now(ctx)
+	} else {
+		after, err = e.Dao.PositionAfter(ctx, id)
+	}
+	if err != nil {
+		return e.closed(ctx, err)
+	}
+
+	ticker := time.NewTicker(e.Poll)
+	defer ticker.Stop()
+
+	for {
+		events, err := e.Dao.FindAfter(ctx, after, eventBatch)
+		if err != nil {
+			return e.closed(ctx, err)
+		}
+		if len(events) > 0 {
+			after = events[len(events)-1].Position
+			events, err = e.render(ctx, events, view)
+			if err != nil {
+				return e.closed(ctx, err)
+			}
+			if err := fn(events); err != nil {
+				return err
+			}
+			//Catch up before waiting again
+			if len(events) == eventBatch {
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-wake:
+		case <-ticker.C:
+			if err := fn(nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// PurgeEvents deletes events past the retention window. Subscribers can't
+// resume from before it.
+func (e *Events) PurgeEvents(ctx context.Context) (int, error) {
+	return e.Dao.PurgeBefore(ctx, time.Now().UTC().Add(-e.Retention))
+}
+
+// Attach the current state of the orders that still exist and that the
+// caller can read. Deleted orders only carry their id.
+func (e *Events) render(ctx context.Context, events []models.OrderEvent, view View) ([]models.OrderEvent, error) {
+	var ids []int64
+	for _, event := range events {
+		if event.Type != models.EventDeleted {
+			ids = append(ids, event.OrderId)
+		}
+	}
+
+	eOrders, err := e.Orders.Dao.FindByIds(ctx, ids)
+	if err != nil {
+		return events, err
+	}
+	orders, err := e.Orders.readOrders(ctx, eOrders, view)
+	if err != nil {
+		return events, err
+	}
+
+	byId := make(map[int64]models.Order)
+	for _, order := range orders {
+		byId[order.Id] = order
+	}
+	for i := range events {
+		if order, ok := byId[events[i].OrderId]; ok && events[i].Type != models.EventDeleted {
+			events[i].Order = &order
+		}
+	}
+
+	return events, nil
+}
+
+// A subscriber that went away isn't an error
+func (e *Events) closed(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (e *Events) subscribe() chan struct{} {
+	wake := make(chan struct{}, 1)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.subscribers == nil {
+		e.subscribers = make(map[chan struct{}]struct{})
+	}
+	e.subscribers[wake] = struct{}{}
+	return wake
+}
+
+func (e *Events) unsubscribe(wake chan struct{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.subscribers, wake)
+}
+
+func (e *Events) broadcast() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for wake := range e.subscribers {
+		//A subscriber already due to read will see this event too
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+var (
+	// ErrKeyReused is returned when an idempotency key comes back with a different order
+	ErrKeyReused = errors.New("Idempotency key was already used for a different order.")
+	// ErrKeyInFlight is returned while the first request for a key is still running
+	ErrKeyInFlight = errors.New("A request with this idempotency key is still in progress.")
+)
+
+// CreateOrderOnce creates an order at most once per caller and idempotency
+// key. A retry with the same order gets the first response back, with true
+// to say it was replayed.
+func (o *Order) CreateOrderOnce(ctx context.Context, key string, order models.Order) (models.Order, bool, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.CreateOrderOnce")
+	defer span.End()
+
+	//Don't hold a key for an order we would reject anyway
+	order = normalize(order)
+	if err := o.validate(order); err != nil {
+		return order, false, err
+	}
+
+	caller := callerName(ctx)
+
+	fingerprint, err := o.fingerprint(ctx, order)
+	if err != nil {
+		return order, false, err
+	}
+
+	now := time.Now().UTC()
+	claimed, err := o.Keys.Claim(ctx, models.IdempotencyKey{
+		Caller:      caller,
+		Key:         key,
+		Fingerprint: fingerprint,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(o.KeyTTL),
+	})
+	if err != nil {
+		return order, false, err
+	}
+	if !claimed {
+		replayed, err := o.replay(ctx, caller, key, fingerprint)
+		return replayed, err == nil, err
+	}
+
+	created, err := o.CreateOrder(ctx, order)
+	if err != nil {
+		//Let the client retry a request that didn't go through
+		if releaseErr := o.Keys.Release(ctx, caller, key); releaseErr != nil {
+			logger(ctx).WithError(releaseErr).Warn("Unable to release idempotency key")
+		}
+		return created, false, err
+	}
+
+	response, err := json.Marshal(created)
+	if err != nil {
+		return created, false, err
+	}
+	stored := models.IdempotencyKey{
+		Caller:        caller,
+		Key:           key,
+		OrderId:       created.Id,
+		CustomerIndex: created.CustomerIndex,
+		Response:      string(response),
+	}
+	if err := o.Encyrption.Encrypt(ctx, &stored); err != nil {
+		return created, false, err
+	}
+	if err := o.Keys.Complete(ctx, stored); err != nil {
+		return created, false, err
+	}
+
+	return created, false, nil
+}
+
+// PurgeKeys deletes idempotency keys past their TTL
+func (o *Order) PurgeKeys(ctx context.Context) (int, error) {
+	return o.Keys.PurgeExpired(ctx, time.Now().UTC())
+}
+
+// Return the stored response for a key held by an earlier request
+func (o *Order) replay(ctx context.Context, caller string, key string, fingerprint string) (models.Order, error) {
+	var order models.Order
+
+	stored, err := o.Keys.Find(ctx, caller, key)
+	if err == dao.ErrNotFound {
+		//Released by a failed request between our claim and lookup
+		return order, ErrKeyInFlight
+	}
+	if err != nil {
+		return order, err
+	}
+	if stored.Fingerprint != fingerprint {
+		return order, ErrKeyReused
+	}
+	if stored.OrderId == 0 {
+		return order, ErrKeyInFlight
+	}
+
+	failed, err := o.Encyrption.Decrypt(ctx, &stored)
+	if err == nil {
+		err = failed[0]
+	}
+	if err != nil {
+		return order, err
+	}
+	if err := o.audit(ctx, audit.Decrypt, []int64{stored.OrderId}); err != nil {
+		return order, err
+	}
+
+	err = json.Unmarshal([]byte(stored.Response), &order)
+	return order, err
+}
+
+// Transit HMAC of the fields a caller sends, so a reused key can be spotted
+// without keeping the customer name in the clear
+func (o *Order) fingerprint(ctx context.Context, order models.Order) (string, error) {
+	fields := []interface{}{"v1", order.CustomerName, order.ProductName}
+	switch {
+	case order.CustomerId > 0:
+		fields[0] = "v3"
+		fields = append(fields, canonicalItems(order.Items), order.CustomerId)
+	case len(order.Items) > 0:
+		fields[0] = "v2"
+		fields = append(fields, canonicalItems(order.Items))
+	}
+	encoded, _ := json.Marshal(fields)
+	encode := base64.StdEncoding.EncodeToString(encoded)
+	return o.Vault.HMAC(ctx, fmt.Sprintf("%s/hmac/%s", o.Encyrption.Mount, o.Encyrption.Key), encode)
+}
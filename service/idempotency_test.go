@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/lanceplarsen/go-vault-demo/client"
+	"github.com/lanceplarsen/go-vault-demo/encryption"
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+// Order service against a Vault whose HMAC echoes its input
+func newHMACOrder(t *testing.T) *Order {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data := map[string]interface{}{"renewable": false, "ttl": 3600}
+		if r.URL.Path == "/v1/transit/hmac/order" {
+			var body struct {
+				Input string `json:"input"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			data = map[string]interface{}{"hmac": "vault:v1:" + body.Input}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	t.Cleanup(server.Close)
+
+	u, _ := url.Parse(server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	vault := &client.Vault{Scheme: u.Scheme, Host: host, Port: port, Authentication: "token", Credential: client.Credential{Token: "test"}}
+	if err := vault.Initialize(); err != nil {
+		t.Fatalf("Initialize() = %v", err)
+	}
+
+	return &Order{Vault: vault, Encyrption: encryption.Transit{Vault: vault, Mount: "transit", Key: "order"}}
+}
+
+func TestFingerprint(t *testing.T) {
+	o := newHMACOrder(t)
+	base := func() models.Order {
+		return models.Order{
+			CustomerName: "Lance",
+			ProductName:  "Vault",
+			Items:        []models.LineItem{{Sku: "vault-ent", Quantity: 2, UnitPrice: 500, Currency: "USD"}},
+		}
+	}
+
+	cases := []struct {
+		name   string
+		change func(o *models.Order)
+		same   bool
+	}{
+		{"unchanged", func(o *models.Order) {}, true},
+		{"customer name", func(o *models.Order) { o.CustomerName = "Bob" }, false},
+		{"product", func(o *models.Order) { o.ProductName = "Consul" }, false},
+		{"quantity", func(o *models.Order) { o.Items[0].Quantity = 3 }, false},
+		{"currency", func(o *models.Order) { o.Items[0].Currency = "EUR" }, false},
+		{"no items", func(o *models.Order) { o.Items = nil }, false},
+		{"customer", func(o *models.Order) { o.CustomerName = ""; o.CustomerId = 7 }, false},
+		{"item total", func(o *models.Order) { o.Items[0].Total = 1000 }, true},
+		{"order date", func(o *models.Order) { o.OrderDate = o.OrderDate.AddDate(0, 0, 1) }, true},
+		{"status", func(o *models.Order) { o.Status = models.StatusPaid }, true},
+	}
+
+	want, err := o.fingerprint(context.Background(), base())
+	if err != nil {
+		t.Fatalf("fingerprint() = %v", err)
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order := base()
+			c.change(&order)
+			got, err := o.fingerprint(context.Background(), order)
+			if err != nil {
+				t.Fatalf("fingerprint() = %v", err)
+			}
+			if (got == want) != c.same {
+				t.Errorf("fingerprint() after changing the %s matched = %v, want %v", c.name, got == want, c.same)
+			}
+		})
+	}
+}
+
+// Customers named like other fields mustn't collide with them
+func TestFingerprintFieldBoundaries(t *testing.T) {
+	o := newHMACOrder(t)
+
+	a, _ := o.fingerprint(context.Background(), models.Order{CustomerName: "Lance", ProductName: "Vault"})
+	b, _ := o.fingerprint(context.Background(), models.Order{CustomerName: "LanceVault"})
+	c, _ := o.fingerprint(context.Background(), models.Order{CustomerName: "Lance\",\"Vault"})
+	if a == b || a == c || b == c {
+		t.Errorf("fingerprint() collided across field boundaries: %q %q %q", a, b, c)
+	}
+}
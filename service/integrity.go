@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+)
+
+type Signing struct {
+	Key   string
+	Mount string
+	//Either flag tampered orders or exclude them from reads
+	Mode string
+}
+
+// Number of rows the integrity report verifies per page
+const verifyBatch = 100
+
+// VerifyOrders checks the signature on every order and reports the ones that fail
+func (o *Order) VerifyOrders(ctx context.Context) ([]models.IntegrityFailure, error) {
+	var last int64
+	failures := []models.IntegrityFailure{}
+
+	ctx, span := tracing.Start(ctx, "service.Order.VerifyOrders")
+	defer span.End()
+
+	for {
+		orders, err := o.Dao.FindAfter(ctx, last, verifyBatch)
+		if err != nil {
+			return failures, err
+		}
+		if len(orders) == 0 {
+			return failures, nil
+		}
+
+		valid, err := o.verify(ctx, orders)
+		if err != nil {
+			return failures, err
+		}
+		for i, order := range orders {
+			if valid[i] {
+				continue
+			}
+			reason := "Signature does not match"
+			if len(order.Signature) == 0 {
+				reason = "Signature missing"
+			}
+			failures = append(failures, models.IntegrityFailure{Id: order.Id, Reason: reason})
+		}
+
+		last = orders[len(orders)-1].Id
+	}
+}
+
+// Sign the stored form of an order. Call after encryption so the
+// ciphertext is what gets signed.
+func (o *Order) sign(ctx context.Context, order *models.Order) error {
+	signature, err := o.Vault.Sign(ctx, fmt.Sprintf("%s/sign/%s", o.Signing.Mount, o.Signing.Key), canonicalOrder(*order))
+	if err != nil {
+		return err
+	}
+	order.Signature = signature
+	return nil
+}
+
+// Sign the stored form of many orders in one transit call
+func (o *Order) signBatch(ctx context.Context, orders []models.Order) error {
+	var inputs []string
+	for _, order := range orders {
+		inputs = append(inputs, canonicalOrder(order))
+	}
+
+	signatures, errs, err := o.Vault.SignBatch(ctx, fmt.Sprintf("%s/sign/%s", o.Signing.Mount, o.Signing.Key), inputs)
+	if err != nil {
+		return err
+	}
+	for i := range orders {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		orders[i].Signature = signatures[i]
+	}
+	return nil
+}
+
+// Orders written before signing shipped have no signature. They're reported
+// invalid here rather than sent to transit, which rejects an empty signature.
+func (o *Order) verify(ctx context.Context, orders []models.Order) ([]bool, error) {
+	var signed []int
+	var inputs []string
+	var signatures []string
+	valid := make([]bool, len(orders))
+
+	for i, order := range orders {
+		if len(order.Signature) == 0 {
+			continue
+		}
+		signed = append(signed, i)
+		inputs = append(inputs, canonicalOrder(order))
+		signatures = append(signatures, order.Signature)
+	}
+
+	results, err := o.Vault.VerifyBatch(ctx, fmt.Sprintf("%s/verify/%s", o.Signing.Mount, o.Signing.Key), inputs, signatures)
+	if err != nil {
+		return nil, err
+	}
+	for j, i := range signed {
+		valid[i] = results[j]
+	}
+	return valid, nil
+}
+
+// Flag or drop orders whose signature doesn't match their stored fields
+func (o *Order) checkIntegrity(ctx context.Context, eOrders []models.Order) ([]models.Order, error) {
+	var checked []models.Order
+
+	valid, err := o.verify(ctx, eOrders)
+	if err != nil {
+		return checked, err
+	}
+
+	for i, order := range eOrders {
+		if !valid[i] {
+			logger(ctx).WithField("order_id", order.Id).Warn("Order failed signature verification")
+			if o.Signing.Mode == "exclude" {
+				continue
+			}
+			order.Tampered = true
+		}
+		checked = append(checked, order)
+	}
+
+	return checked, nil
+}
+
+// The key context isn't signed since the ciphertext is already bound to it.
+// The customer index, deleted_at and purged_at aren't signed either, so
+// someone who can write to the table can change which customer an order is
+// found and erased under, or restore a deleted order, without failing
+// verification. Dates are truncated to what Postgres stores.
+// Each form is kept as it shipped so older signatures keep verifying: v1 for
+// orders signed before they had a mask, v5 for masked orders still in
+// created, v2 for orders without items, v3 for orders without a customer
+// reference and v4 for the rest.
+func canonicalOrder(order models.Order) string {
+	var fields []interface{}
+
+	date := order.OrderDate.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano)
+	switch {
+	case order.CustomerId > 0:
+		fields = []interface{}{"v4", order.Id, order.CustomerName, order.CustomerMask, order.ProductName, date,
+			order.Status, canonicalItems(order.Items), order.CustomerId}
+	case len(order.Items) > 0:
+		fields = []interface{}{"v3", order.Id, order.CustomerName, order.CustomerMask, order.ProductName, date,
+			order.Status, canonicalItems(order.Items)}
+	case order.Status != models.StatusCreated:
+		fields = []interface{}{"v2", order.Id, order.CustomerName, order.CustomerMask, order.ProductName, date,
+			order.Status}
+	case len(order.CustomerMask) > 0:
+		fields = []interface{}{"v5", order.Id, order.CustomerName, order.CustomerMask, order.ProductName, date}
+	default:
+		fields = []interface{}{"v1", order.Id, order.CustomerName, order.ProductName, date}
+	}
+	encoded, _ := json.Marshal(fields)
+	return base64.StdEncoding.EncodeToString(encoded)
+}
+
+// Items in order with the fields a caller sets. Totals are derived from them.
+func canonicalItems(items []models.LineItem) [][]interface{} {
+	var fields [][]interface{}
+	for _, item := range items {
+		fields = append(fields, []interface{}{item.Sku, item.Quantity, item.UnitPrice, item.Currency})
+	}
+	return fields
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+func TestCanonicalOrderVersion(t *testing.T) {
+	date := time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)
+	items := []models.LineItem{{Sku: "vault-ent", Quantity: 2, UnitPrice: 500, Currency: "USD"}}
+
+	cases := []struct {
+		name  string
+		order models.Order
+		want  string
+	}{
+		{"original", models.Order{Id: 1, CustomerName: "vault:v1:abc", ProductName: "Vault", OrderDate: date, Status: models.StatusCreated}, "v1"},
+		{"status", models.Order{Id: 1, ProductName: "Vault", OrderDate: date, Status: models.StatusPaid}, "v2"},
+		{"items", models.Order{Id: 1, OrderDate: date, Status: models.StatusCreated, Items: items}, "v3"},
+		{"customer", models.Order{Id: 1, ProductName: "Vault", OrderDate: date, Status: models.StatusCreated, CustomerId: 7}, "v4"},
+		{"mask", models.Order{Id: 1, ProductName: "Vault", OrderDate: date, Status: models.StatusCreated, CustomerMask: "L***e"}, "v5"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			decoded, err := base64.StdEncoding.DecodeString(canonicalOrder(c.order))
+			if err != nil {
+				t.Fatalf("canonicalOrder() isn't base64: %v", err)
+			}
+			var fields []interface{}
+			if err := json.Unmarshal(decoded, &fields); err != nil {
+				t.Fatalf("canonicalOrder() isn't a JSON array: %v", err)
+			}
+			if fields[0] != c.want {
+				t.Errorf("canonicalOrder() version = %v, want %s", fields[0], c.want)
+			}
+		})
+	}
+}
+
+// Orders signed before later fields existed must keep verifying
+func TestCanonicalOrderV1(t *testing.T) {
+	order := models.Order{
+		Id:           204,
+		CustomerName: "vault:v1:abc",
+		ProductName:  "Vault-Ent",
+		OrderDate:    time.Date(2019, 3, 1, 12, 0, 0, 123456789, time.FixedZone("EST", -5*60*60)),
+		Status:       models.StatusCreated,
+	}
+
+	want := base64.StdEncoding.EncodeToString([]byte(`["v1",204,"vault:v1:abc","Vault-Ent","2019-03-01T17:00:00.123456Z"]`))
+	if got := canonicalOrder(order); got != want {
+		t.Errorf("canonicalOrder() = %s, want %s", got, want)
+	}
+}
+
+func TestCanonicalOrderFields(t *testing.T) {
+	base := func() models.Order {
+		return models.Order{
+			Id:            1,
+			CustomerName:  "vault:v1:abc",
+			CustomerIndex: "vault:v1:index",
+			KeyContext:    "order-1",
+			CustomerMask:  "L***e",
+			CustomerId:    7,
+			ProductName:   "Vault",
+			OrderDate:     time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC),
+			Status:        models.StatusPaid,
+			Items:         []models.LineItem{{Sku: "vault-ent", Quantity: 2, UnitPrice: 500, Currency: "USD", Total: 1000}},
+			Signature:     "vault:v1:signature",
+		}
+	}
+
+	cases := []struct {
+		name   string
+		change func(o *models.Order)
+		signed bool
+	}{
+		{"id", func(o *models.Order) { o.Id = 2 }, true},
+		{"customer name", func(o *models.Order) { o.CustomerName = "vault:v1:def" }, true},
+		{"mask", func(o *models.Order) { o.CustomerMask = "B*b" }, true},
+		{"customer", func(o *models.Order) { o.CustomerId = 8 }, true},
+		{"product", func(o *models.Order) { o.ProductName = "Consul" }, true},
+		{"date", func(o *models.Order) { o.OrderDate = o.OrderDate.Add(time.Second) }, true},
+		{"status", func(o *models.Order) { o.Status = models.StatusShipped }, true},
+		{"quantity", func(o *models.Order) { o.Items[0].Quantity = 3 }, true},
+		{"price", func(o *models.Order) { o.Items[0].UnitPrice = 1 }, true},
+		{"currency", func(o *models.Order) { o.Items[0].Currency = "EUR" }, true},
+		{"extra item", func(o *models.Order) { o.Items = append(o.Items, o.Items[0]) }, true},
+		{"date zone", func(o *models.Order) { o.OrderDate = o.OrderDate.In(time.FixedZone("CET", 60*60)) }, false},
+		{"date nanoseconds", func(o *models.Order) { o.OrderDate = o.OrderDate.Add(time.Nanosecond) }, false},
+		{"index", func(o *models.Order) { o.CustomerIndex = "vault:v1:other" }, false},
+		{"key context", func(o *models.Order) { o.KeyContext = "order-2" }, false},
+		{"item total", func(o *models.Order) { o.Items[0].Total = 1 }, false},
+		{"signature", func(o *models.Order) { o.Signature = "" }, false},
+	}
+
+	want := canonicalOrder(base())
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			order := base()
+			c.change(&order)
+			if changed := canonicalOrder(order) != want; changed != c.signed {
+				t.Errorf("changing the %s changed the canonical order = %v, want %v", c.name, changed, c.signed)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidTransition is returned when an order can't move to the requested status
+	ErrInvalidTransition = errors.New("Order can't move to the requested status.")
+	// ErrOrderClosed is returned when changing an order that was delivered or cancelled
+	ErrOrderClosed = errors.New("Order is closed and can't be changed.")
+)
+
+// Statuses an order can move to from each status. Orders can be cancelled
+// until they ship.
+var transitions = map[string][]string{
+	models.StatusCreated:   {models.StatusPaid, models.StatusCancelled},
+	models.StatusPaid:      {models.StatusShipped, models.StatusCancelled},
+	models.StatusShipped:   {models.StatusDelivered},
+	models.StatusDelivered: {},
+	models.StatusCancelled: {},
+}
+
+// TransitionOrder moves an order to a new status, re-signs it and records
+// the change with the caller in the order's history.
+func (o *Order) TransitionOrder(ctx context.Context, id int64, status string) (models.OrderTransition, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.TransitionOrder")
+	defer span.End()
+
+	var transition models.OrderTransition
+
+	status = strings.ToLower(strings.TrimSpace(status))
+	if _, ok := transitions[status]; !ok {
+		invalid := &ValidationError{}
+		invalid.add("Status", "must be one of created, paid, shipped, delivered or cancelled")
+		return transition, invalid
+	}
+
+	order, err := o.GetOrder(ctx, id, Ciphertext)
+	if err != nil {
+		return transition, err
+	}
+	//Don't re-sign an order that was changed behind our back
+	if order.Tampered {
+		return transition, ErrTampered
+	}
+	if !canTransition(order.Status, status) {
+		return transition, ErrInvalidTransition
+	}
+
+	transition = models.OrderTransition{
+		OrderId:   order.Id,
+		From:      order.Status,
+		To:        status,
+		Actor:     callerName(ctx),
+		RequestId: audit.RequestIDFromContext(ctx),
+		Time:      time.Now().UTC(),
+	}
+
+	//The status is signed with the rest of the stored order
+	order.Status = status
+	if err := o.sign(ctx, &order); err != nil {
+		return transition, err
+	}
+	if err := o.Dao.Transition(ctx, order, transition); err != nil {
+		return transition, err
+	}
+
+	logger(ctx).WithFields(log.Fields{
+		"order_id": order.Id,
+		"from":     transition.From,
+		"to":       transition.To,
+	}).Info("Order status changed")
+
+	return transition, nil
+}
+
+// OrderHistory returns the status changes of an order, oldest first
+func (o *Order) OrderHistory(ctx context.Context, id int64) ([]models.OrderTransition, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.OrderHistory")
+	defer span.End()
+
+	//Orders hidden from reads have no history either
+	if _, err := o.GetOrder(ctx, id, Ciphertext); err != nil {
+		return []models.OrderTransition{}, err
+	}
+	return o.Dao.Transitions(ctx, id)
+}
+
+func canTransition(from string, to string) bool {
+	for _, next := range transitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivered and cancelled orders can't move or be edited
+func closed(status string) bool {
+	return len(transitions[status]) == 0
+}
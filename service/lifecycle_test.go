@@ -0,0 +1,58 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+func TestCanTransition(t *testing.T) {
+	cases := []struct {
+		from string
+		to   string
+		want bool
+	}{
+		{models.StatusCreated, models.StatusPaid, true},
+		{models.StatusCreated, models.StatusCancelled, true},
+		{models.StatusCreated, models.StatusShipped, false},
+		{models.StatusCreated, models.StatusCreated, false},
+		{models.StatusPaid, models.StatusShipped, true},
+		{models.StatusPaid, models.StatusCancelled, true},
+		{models.StatusPaid, models.StatusCreated, false},
+		{models.StatusShipped, models.StatusDelivered, true},
+		{models.StatusShipped, models.StatusCancelled, false},
+		{models.StatusDelivered, models.StatusCancelled, false},
+		{models.StatusCancelled, models.StatusPaid, false},
+		{"", models.StatusPaid, false},
+		{models.StatusCreated, "refunded", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.from+"->"+c.to, func(t *testing.T) {
+			if got := canTransition(c.from, c.to); got != c.want {
+				t.Errorf("canTransition(%q, %q) = %v, want %v", c.from, c.to, got, c.want)
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	cases := []struct {
+		status string
+		want   bool
+	}{
+		{models.StatusCreated, false},
+		{models.StatusPaid, false},
+		{models.StatusShipped, false},
+		{models.StatusDelivered, true},
+		{models.StatusCancelled, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.status, func(t *testing.T) {
+			if got := closed(c.status); got != c.want {
+				t.Errorf("closed(%q) = %v, want %v", c.status, got, c.want)
+			}
+		})
+	}
+}
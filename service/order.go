@@ -1,77 +1,608 @@
 package service
 
 import (
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"log"
-	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/auth"
 	"github.com/lanceplarsen/go-vault-demo/client"
 	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/encryption"
 	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	log "github.com/sirupsen/logrus"
 )
 
 type Order struct {
 	Vault      *client.Vault
 	Dao        *dao.Order
-	Encyrption Transit
+	Tombstones *dao.Tombstone
+	Customers  *dao.Customer
+	Encyrption encryption.Transit
+	Signing    Signing
+	Audit      *audit.Log
+	//Products that can be ordered. Empty allows any
+	Catalog []string
+	Keys    *dao.Idempotency
+	//How long an idempotency key is remembered
+	KeyTTL time.Duration
+	//How long deleted orders can be restored, and how they are purged after
+	Retention time.Duration
+	PurgeMode string
 }
 
-type Transit struct {
-	Key   string
-	Mount string
+// How much of the encrypted fields a caller gets to see
+type View string
+
+const (
+	Clear      View = "clear"
+	Masked     View = "mask"
+	Ciphertext View = "ciphertext"
+)
+
+// ErrTampered is returned when changing an order that failed verification
+var ErrTampered = errors.New("Order failed signature verification.")
+
+// Number of rows the backfill job updates per page
+const backfillBatch = 100
+
+func (o *Order) GetOrders(ctx context.Context, view View) ([]models.Order, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.GetOrders")
+	defer span.End()
+
+	eOrders, err := o.Dao.FindAll(ctx)
+	if err != nil {
+		return []models.Order{}, err
+	}
+
+	return o.readOrders(ctx, eOrders, view)
 }
 
-func (o *Order) GetOrders() ([]models.Order, error) {
-	var eOrders []models.Order
-	var dOrders []models.Order
+func (o *Order) GetOrdersByCustomer(ctx context.Context, customer string, view View) ([]models.Order, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.GetOrdersByCustomer")
+	defer span.End()
 
-	eOrders, err := o.Dao.FindAll()
+	//Compute the blind index for the lookup
+	index, err := o.CustomerIndex(ctx, customer)
 	if err != nil {
 		return []models.Order{}, err
 	}
 
-	//Decrypt these. TODO Could use a batch decyrpt opp here
-	for _, order := range eOrders {
-		dOrder, err := o.Vault.Decrypt(fmt.Sprintf("%s/decrypt/%s", o.Encyrption.Mount, o.Encyrption.Key), order.CustomerName)
+	eOrders, err := o.Dao.FindByCustomerIndex(ctx, index)
+	if err != nil {
+		return []models.Order{}, err
+	}
+
+	return o.readOrders(ctx, eOrders, view)
+}
+
+func (o *Order) CreateOrder(ctx context.Context, order models.Order) (models.Order, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.CreateOrder")
+	defer span.End()
+
+	order = normalize(order)
+	if err := o.validate(order); err != nil {
+		return order, err
+	}
+	if err := o.referenceCustomer(ctx, &order); err != nil {
+		return order, err
+	}
+
+	//Add a timestamp at the precision Postgres keeps so the signature still matches
+	order.OrderDate = time.Now().UTC().Truncate(time.Microsecond)
+	order.Status = models.StatusCreated
+
+	//Reserve the id up front since it is part of the signature
+	id, err := o.Dao.NextId(ctx)
+	if err != nil {
+		return order, err
+	}
+	order.Id = id
+
+	//Keep the unencrypted fields to send back to the API
+	plain := order
+
+	if err := o.seal(ctx, &order); err != nil {
+		return order, err
+	}
+
+	//Insert the order with the start of its history
+	order, err = o.Dao.Insert(ctx, order, models.OrderTransition{
+		To:        models.StatusCreated,
+		Actor:     callerName(ctx),
+		RequestId: audit.RequestIDFromContext(ctx),
+		Time:      order.OrderDate,
+	})
+	if err != nil {
+		return plain, err
+	}
+
+	//If the order was inserted successfully send back the unencrypted fields
+	plain.Id = order.Id
+	plain.CustomerIndex = order.CustomerIndex
+	plain.CustomerMask = order.CustomerMask
+
+	return plain, nil
+}
+
+// GetOrder returns a single order. Orders that are hidden from reads, like
+// those of erased customers, are not found.
+func (o *Order) GetOrder(ctx context.Context, id int64, view View) (models.Order, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.GetOrder")
+	defer span.End()
+
+	eOrder, err := o.Dao.FindById(ctx, id)
+	if err != nil {
+		return eOrder, err
+	}
+
+	orders, err := o.readOrders(ctx, []models.Order{eOrder}, view)
+	if err != nil {
+		return eOrder, err
+	}
+	if len(orders) == 0 {
+		return eOrder, dao.ErrNotFound
+	}
+	return orders[0], nil
+}
+
+// UpdateOrder replaces the customer and product of an existing order. The
+// order date and status are kept and the order is re-indexed, re-encrypted
+// and re-signed. Delivered and cancelled orders can't be updated.
+func (o *Order) UpdateOrder(ctx context.Context, order models.Order) (models.Order, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.UpdateOrder")
+	defer span.End()
+
+	order = normalize(order)
+	if err := o.validate(order); err != nil {
+		return order, err
+	}
+	if err := o.referenceCustomer(ctx, &order); err != nil {
+		return order, err
+	}
+
+	existing, err := o.GetOrder(ctx, order.Id, Ciphertext)
+	if err != nil {
+		return order, err
+	}
+	//Don't re-sign an order that was changed behind our back
+	if existing.Tampered {
+		return order, ErrTampered
+	}
+	if closed(existing.Status) {
+		return order, ErrOrderClosed
+	}
+	order.OrderDate = existing.OrderDate
+	order.Status = existing.Status
+	order.KeyContext = existing.KeyContext
+
+	//Keep the unencrypted fields to send back to the API
+	plain := order
+
+	if err := o.seal(ctx, &order); err != nil {
+		return order, err
+	}
+	if err := o.Dao.Update(ctx, order); err != nil {
+		return order, err
+	}
+
+	plain.CustomerIndex = order.CustomerIndex
+	plain.CustomerMask = order.CustomerMask
+
+	return plain, nil
+}
+
+// DeleteOrder soft deletes an order. It can be restored until the retention
+// purge removes it.
+func (o *Order) DeleteOrder(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "service.Order.DeleteOrder")
+	defer span.End()
+
+	if err := o.Dao.Delete(ctx, id, time.Now().UTC()); err != nil {
+		return err
+	}
+	return o.audit(ctx, audit.Delete, []int64{id})
+}
+
+// DeleteOrders soft deletes every order
+func (o *Order) DeleteOrders(ctx context.Context) error {
+	ctx, span := tracing.Start(ctx, "service.Order.DeleteOrders")
+	defer span.End()
+
+	ids, err := o.Dao.DeleteAll(ctx, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return o.audit(ctx, audit.Delete, ids)
+}
+
+// EraseCustomer deletes a customer's orders and tombstones their derivation
+// context so ciphertext restored from a backup is never decrypted again.
+func (o *Order) EraseCustomer(ctx context.Context, customer string) (int, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.EraseCustomer")
+	defer span.End()
+
+	index, err := o.CustomerIndex(ctx, customer)
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := o.Tombstones.Erase(ctx, index, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), o.audit(ctx, audit.Erase, ids)
+}
+
+// CustomerIndex returns the transit HMAC of the normalized customer name
+func (o *Order) CustomerIndex(ctx context.Context, customer string) (string, error) {
+	return o.hmac(ctx, normalizeCustomer(customer))
+}
+
+// Blind index of a value under the transit key
+func (o *Order) hmac(ctx context.Context, value string) (string, error) {
+	encode := base64.StdEncoding.EncodeToString([]byte(value))
+	return o.Vault.HMAC(ctx, fmt.Sprintf("%s/hmac/%s", o.Encyrption.Mount, o.Encyrption.Key), encode)
+}
+
+// Blind index of each value in one transit call
+func (o *Order) hmacBatch(ctx context.Context, values []string) ([]string, error) {
+	var inputs []string
+	for _, value := range values {
+		inputs = append(inputs, base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+
+	hmacs, errs, err := o.Vault.HMACBatch(ctx, fmt.Sprintf("%s/hmac/%s", o.Encyrption.Mount, o.Encyrption.Key), inputs)
+	if err != nil {
+		return nil, err
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return hmacs, nil
+}
+
+// Orders that reference a customer share its index and mask, so search
+// finds them, but don't store the name again. Erasing the customer by id
+// removes them.
+func (o *Order) referenceCustomer(ctx context.Context, order *models.Order) error {
+	if order.CustomerId == 0 {
+		return nil
+	}
+
+	customer, err := o.Customers.FindById(ctx, order.CustomerId)
+	if err == dao.ErrCustomerNotFound {
+		invalid := &ValidationError{}
+		invalid.add("CustomerId", "does not exist")
+		return invalid
+	}
+	if err != nil {
+		return err
+	}
+
+	order.CustomerIndex = customer.CustomerIndex
+	order.CustomerMask = customer.NameMask
+	return nil
+}
+
+// Fill in the name of orders that reference a customer from the customer
+func (o *Order) fillCustomers(ctx context.Context, orders []models.Order) ([]models.Order, error) {
+	var ids []int64
+	for _, order := range orders {
+		if order.CustomerId > 0 {
+			ids = append(ids, order.CustomerId)
+		}
+	}
+	if len(ids) == 0 {
+		return orders, nil
+	}
+
+	eCustomers, err := o.Customers.FindByIds(ctx, ids)
+	if err != nil {
+		return orders, err
+	}
+	reader := Customer{Orders: o, Dao: o.Customers}
+	customers, err := reader.readCustomers(ctx, eCustomers, Clear)
+	if err != nil {
+		return orders, err
+	}
+
+	names := make(map[int64]string)
+	for _, customer := range customers {
+		names[customer.Id] = customer.Name
+	}
+	for i := range orders {
+		if orders[i].CustomerId > 0 {
+			orders[i].CustomerName = names[orders[i].CustomerId]
+		}
+	}
+
+	return orders, nil
+}
+
+// Backfill brings orders written by older releases up to the current stored
+// form. It computes a missing blind index and mask, and re-encrypts names
+// without a key context of their own, like those under the legacy key, under
+// a new one. Orders whose signature verified are re-signed. Orders whose
+// signature doesn't verify are left alone, since re-signing would launder a
+// tampered row, and unsigned orders stay unsigned.
+func (o *Order) Backfill(ctx context.Context) (int, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.Backfill")
+	defer span.End()
+
+	var last int64
+	var count int
+
+	for {
+		orders, err := o.Dao.FindUnindexed(ctx, last, backfillBatch)
+		if err != nil {
+			return count, err
+		}
+		if len(orders) == 0 {
+			return count, nil
+		}
+
+		//Check the old signatures before anything about the rows changes
+		valid, err := o.verify(ctx, orders)
+		if err != nil {
+			return count, err
+		}
+
+		dOrders, err := o.decryptOrders(ctx, orders)
+		if err != nil {
+			return count, err
+		}
+		names := make(map[int64]string)
+		for _, order := range dOrders {
+			names[order.Id] = order.CustomerName
+		}
+
+		var rewrapped []int64
+		for i, order := range orders {
+			name, ok := names[order.Id]
+			if !ok {
+				continue
+			}
+			if len(order.Signature) > 0 && !valid[i] {
+				logger(ctx).WithField("order_id", order.Id).Warn("Not backfilling order that failed signature verification")
+				continue
+			}
+			if len(order.CustomerIndex) == 0 {
+				index, err := o.CustomerIndex(ctx, name)
+				if err != nil {
+					logger(ctx).WithField("order_id", order.Id).WithError(err).Warn("Unable to index order")
+					continue
+				}
+				order.CustomerIndex = index
+			}
+			if len(order.CustomerMask) == 0 {
+				order.CustomerMask = maskCustomer(name)
+			}
+			if order.CustomerId == 0 && len(order.KeyContext) == 0 {
+				order.CustomerName = name
+				if order.KeyContext, err = newKeyContext(); err != nil {
+					return count, err
+				}
+				if err := o.Encyrption.Encrypt(ctx, &order); err != nil {
+					return count, err
+				}
+				rewrapped = append(rewrapped, order.Id)
+			}
+			if valid[i] {
+				if err := o.sign(ctx, &order); err != nil {
+					return count, err
+				}
+			}
+			if err := o.Dao.Reindex(ctx, order); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(rewrapped) > 0 {
+			if err := o.audit(ctx, audit.Encrypt, rewrapped); err != nil {
+				return count, err
+			}
+		}
+
+		//Page past rows that failed so we don't spin on them
+		last = orders[len(orders)-1].Id
+	}
+}
+
+// Verify signatures on the stored rows, then only decrypt them for callers
+// allowed to see the clear text
+func (o *Order) readOrders(ctx context.Context, eOrders []models.Order, view View) ([]models.Order, error) {
+	eOrders, err := o.checkIntegrity(ctx, eOrders)
+	if err != nil {
+		return []models.Order{}, err
+	}
+
+	if view == Clear {
+		dOrders, err := o.decryptOrders(ctx, eOrders)
 		if err != nil {
-			log.Printf("Unable to decrypt order: %s", strconv.FormatInt(order.Id, 10))
+			return dOrders, err
+		}
+		return o.fillCustomers(ctx, dOrders)
+	}
+
+	eOrders, err = o.withoutErased(ctx, eOrders)
+	if err != nil {
+		return []models.Order{}, err
+	}
+	if view == Masked {
+		for i := range eOrders {
+			eOrders[i].CustomerName = eOrders[i].CustomerMask
+			if len(eOrders[i].CustomerName) == 0 {
+				eOrders[i].CustomerName = maskCustomer("")
+			}
+		}
+	}
+
+	return eOrders, nil
+}
+
+func (o *Order) decryptOrders(ctx context.Context, eOrders []models.Order) ([]models.Order, error) {
+	var dOrders []models.Order
+	var ids []int64
+
+	//Never decrypt rows for erased customers
+	eOrders, err := o.withoutErased(ctx, eOrders)
+	if err != nil {
+		return []models.Order{}, err
+	}
+
+	//Orders from before key contexts were derived from their name index
+	for i := range eOrders {
+		if len(eOrders[i].KeyContext) == 0 {
+			eOrders[i].KeyContext = eOrders[i].CustomerIndex
+		}
+	}
+
+	//Decrypt the tagged fields in one batch
+	failed, err := o.Encyrption.Decrypt(ctx, eOrders)
+	if err != nil {
+		return []models.Order{}, err
+	}
+
+	for i, order := range eOrders {
+		if failed[i] != nil {
+			logger(ctx).WithField("order_id", order.Id).WithError(failed[i]).Warn("Unable to decrypt order")
 		} else {
-			sDec, _ := base64.StdEncoding.DecodeString(dOrder)
-			order.CustomerName = string(sDec)
 			dOrders = append(dOrders, order)
+			ids = append(ids, order.Id)
+		}
+	}
+
+	//Don't hand out plaintext we couldn't account for
+	if len(ids) > 0 {
+		if err := o.audit(ctx, audit.Decrypt, ids); err != nil {
+			return []models.Order{}, err
 		}
 	}
 
 	return dOrders, nil
 }
 
-func (o *Order) CreateOrder(order models.Order) (models.Order, error) {
-	//Get the unencrypted customer to send back to the API
-	ucust := order.CustomerName
+// Index, mask, encrypt and sign an order into its stored form. Orders that
+// reference a customer already carry its index and mask and have no name to
+// encrypt.
+func (o *Order) seal(ctx context.Context, order *models.Order) error {
+	if order.CustomerId == 0 {
+		//Blind index so we can search without decrypting
+		index, err := o.CustomerIndex(ctx, order.CustomerName)
+		if err != nil {
+			return err
+		}
+		order.CustomerIndex = index
 
-	//Add a timestamp
-	order.OrderDate = time.Now()
+		//Masked form for callers who can't see the customer
+		order.CustomerMask = maskCustomer(order.CustomerName)
 
-	//Encrypt it
-	encode := base64.StdEncoding.EncodeToString([]byte(order.CustomerName))
-	cipher, err := o.Vault.Encrypt(fmt.Sprintf("%s/encrypt/%s", o.Encyrption.Mount, o.Encyrption.Key), encode)
+		//Key the name to this order alone so it can be shredded on its own
+		if len(order.KeyContext) == 0 {
+			order.KeyContext, err = newKeyContext()
+			if err != nil {
+				return err
+			}
+		}
+
+		//Encrypt the tagged fields
+		if err := o.Encyrption.Encrypt(ctx, order); err != nil {
+			return err
+		}
+		if err := o.audit(ctx, audit.Encrypt, []int64{order.Id}); err != nil {
+			return err
+		}
+	}
+
+	//Sign what we store
+	return o.sign(ctx, order)
+}
+
+func (o *Order) audit(ctx context.Context, action string, ids []int64) error {
+	if o.Audit == nil {
+		return nil
+	}
+	return o.Audit.Record(ctx, action, ids)
+}
+
+// Name the caller in ctx for records that outlive the request
+func callerName(ctx context.Context) string {
+	if identity := auth.FromContext(ctx); identity != nil {
+		return fmt.Sprintf("%s:%s", identity.Method, identity.Name)
+	}
+	return "anonymous"
+}
+
+// Tag log lines with the request that caused them
+func logger(ctx context.Context) *log.Entry {
+	return log.WithField("request_id", audit.RequestIDFromContext(ctx))
+}
+
+// Drop orders placed before their customer was erased, and shredded orders
+// restored from a backup. Orders that reference a customer hold no name of
+// their own, and the customer record they read it from is checked on its
+// own key context.
+func (o *Order) withoutErased(ctx context.Context, eOrders []models.Order) ([]models.Order, error) {
+	var indexes []string
+	var live []models.Order
+
+	for _, order := range eOrders {
+		if len(order.CustomerIndex) > 0 && order.CustomerId == 0 {
+			indexes = append(indexes, order.CustomerIndex)
+		}
+		if len(order.KeyContext) > 0 {
+			indexes = append(indexes, order.KeyContext)
+		}
+	}
+
+	erased, err := o.Tombstones.FindByCustomerIndexes(ctx, indexes)
 	if err != nil {
-		return order, err
+		return live, err
+	}
+
+	for _, order := range eOrders {
+		if erasedAt, ok := erased[order.CustomerIndex]; ok && order.CustomerId == 0 && !order.OrderDate.After(erasedAt) {
+			logger(ctx).WithField("order_id", order.Id).Info("Refusing to decrypt order for erased customer")
+			continue
+		}
+		if _, ok := erased[order.KeyContext]; ok && len(order.KeyContext) > 0 {
+			logger(ctx).WithField("order_id", order.Id).Info("Refusing to decrypt shredded order")
+			continue
+		}
+		live = append(live, order)
 	}
-	order.CustomerName = cipher
 
-	//Insert the order=
-	order, err = o.Dao.Insert(order)
+	return live, nil
+}
 
-	//If the order was inserted successfully send back the unencrypted customer
-	order.CustomerName = ucust
+// Keep the first and last letter of names long enough to not give them away
+func maskCustomer(customer string) string {
+	runes := []rune(strings.TrimSpace(customer))
+	if len(runes) < 4 {
+		return "***"
+	}
+	return string(runes[0]) + "***" + string(runes[len(runes)-1])
+}
 
-	return order, nil
+// Random derivation context for one record's encrypted fields
+func newKeyContext() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(raw), nil
 }
 
-func (o *Order) DeleteOrders() error {
-	err := o.Dao.DeleteAll()
-	return err
+// Case and whitespace shouldn't change which orders a customer matches
+func normalizeCustomer(customer string) string {
+	return strings.ToLower(strings.Join(strings.Fields(customer), " "))
 }
@@ -0,0 +1,26 @@
+package service
+
+import "testing"
+
+func TestMaskCustomer(t *testing.T) {
+	cases := []struct {
+		customer string
+		want     string
+	}{
+		{"Lance", "L***e"},
+		{"  Lance Larsen ", "L***n"},
+		{"Zoë", "***"},
+		{"Ann", "***"},
+		{"Anna", "A***a"},
+		{"Ōtsuka", "Ō***a"},
+		{"", "***"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.customer, func(t *testing.T) {
+			if got := maskCustomer(c.customer); got != c.want {
+				t.Errorf("maskCustomer(%q) = %q, want %q", c.customer, got, c.want)
+			}
+		})
+	}
+}
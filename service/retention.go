@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/audit"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+// How deleted orders are purged once they are past retention
+const (
+	//Remove the row with its items and history
+	PurgeDelete = "delete"
+	//Tombstone the order's key context and drop the customer's ciphertext,
+	//index and mask but keep the rest
+	PurgeShred = "shred"
+)
+
+// Number of orders the retention job purges per statement
+const purgeBatch = 100
+
+// RestoreOrder brings back a deleted order that hasn't been purged yet
+func (o *Order) RestoreOrder(ctx context.Context, id int64, view View) (models.Order, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.RestoreOrder")
+	defer span.End()
+
+	if err := o.Dao.Restore(ctx, id); err != nil {
+		return models.Order{}, err
+	}
+	if err := o.audit(ctx, audit.Restore, []int64{id}); err != nil {
+		return models.Order{}, err
+	}
+	return o.GetOrder(ctx, id, view)
+}
+
+// PurgeOrders deletes or shreds orders deleted longer ago than the
+// retention window, a batch at a time, and logs and audits what it removed
+func (o *Order) PurgeOrders(ctx context.Context) (int, error) {
+	ctx, span := tracing.Start(ctx, "service.Order.PurgeOrders")
+	defer span.End()
+
+	var count int
+	now := time.Now().UTC()
+	before := now.Add(-o.Retention)
+
+	for {
+		var ids []int64
+		var err error
+		if o.PurgeMode == PurgeShred {
+			ids, err = o.Dao.Shred(ctx, before, now, purgeBatch)
+		} else {
+			ids, err = o.Dao.Purge(ctx, before, purgeBatch)
+		}
+		if err != nil {
+			return count, err
+		}
+		if len(ids) == 0 {
+			return count, nil
+		}
+
+		if err := o.audit(ctx, audit.Purge, ids); err != nil {
+			return count, err
+		}
+		log.WithFields(log.Fields{
+			"mode":           o.PurgeMode,
+			"deleted_before": before,
+			"order_ids":      ids,
+		}).Info("Purged deleted orders")
+		count += len(ids)
+
+		if len(ids) < purgeBatch {
+			return count, nil
+		}
+	}
+}
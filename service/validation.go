@@ -0,0 +1,235 @@
+package service
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+// Longest values we accept. Product names are a varchar(20) column and
+// SKUs a varchar(40) one.
+const (
+	maxCustomerName = 100
+	maxProductName  = 20
+	maxSku          = 40
+	maxEmail        = 254
+	maxAddress      = 500
+	maxUrl          = 2048
+)
+
+// Limits on line items. Prices are in minor units, and these keep an order
+// total well inside an int64.
+const (
+	maxItems     = 100
+	maxQuantity  = 10000
+	maxUnitPrice = 10000000000
+)
+
+// Letters, marks and the punctuation that shows up in people's names
+var customerChars = regexp.MustCompile(`^[\p{L}\p{M} .,'-]+$`)
+
+var productChars = regexp.MustCompile(`^[A-Za-z0-9 ._-]+$`)
+
+// ISO 4217 codes like USD
+var currencyCode = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Loose on purpose, the address is only checked for shape
+var emailAddress = regexp.MustCompile(`^[^@\s]+@[^@\s]+\.[^@\s]+$`)
+
+// Digits with an optional leading + and the usual separators
+var phoneNumber = regexp.MustCompile(`^\+?[0-9][0-9 ().-]{5,30}$`)
+
+type FieldError struct {
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+// ValidationError lists every invalid field of a rejected order or customer
+type ValidationError struct {
+	Fields []FieldError
+	//What was rejected, an order unless set
+	subject string
+}
+
+func (e *ValidationError) Error() string {
+	var reasons []string
+	for _, f := range e.Fields {
+		reasons = append(reasons, fmt.Sprintf("%s %s", f.Field, f.Reason))
+	}
+	subject := e.subject
+	if len(subject) == 0 {
+		subject = "order"
+	}
+	return fmt.Sprintf("Invalid %s: %s", subject, strings.Join(reasons, ", "))
+}
+
+func (e *ValidationError) add(field string, reason string) {
+	e.Fields = append(e.Fields, FieldError{Field: field, Reason: reason})
+}
+
+// Check the fields a caller supplies before anything is sent to Vault or
+// Postgres. An empty catalog allows any product.
+func (o *Order) validate(order models.Order) error {
+	invalid := &ValidationError{}
+
+	//Orders that reference a customer take the name from it
+	customer := strings.TrimSpace(order.CustomerName)
+	switch {
+	case order.CustomerId < 0:
+		invalid.add("CustomerId", "must be positive")
+	case order.CustomerId > 0 && len(customer) > 0:
+		invalid.add("CustomerName", "must be empty when CustomerId is set")
+	case order.CustomerId == 0:
+		validateName(invalid, "CustomerName", customer)
+	}
+
+	//Orders with items don't need the single product name
+	product := strings.TrimSpace(order.ProductName)
+	switch {
+	case len(product) == 0 && len(order.Items) > 0:
+	case len(product) == 0:
+		invalid.add("ProductName", "is required unless the order has items")
+	case utf8.RuneCountInString(product) > maxProductName:
+		invalid.add("ProductName", fmt.Sprintf("must be at most %d characters", maxProductName))
+	case !productChars.MatchString(product):
+		invalid.add("ProductName", "may only contain letters, digits, spaces and . _ -")
+	case len(o.Catalog) > 0 && !inCatalog(o.Catalog, product):
+		invalid.add("ProductName", "is not in the product catalog")
+	}
+
+	if len(order.Items) > maxItems {
+		invalid.add("Items", fmt.Sprintf("must have at most %d items", maxItems))
+	}
+	for i, item := range order.Items {
+		field := fmt.Sprintf("Items.%d.", i)
+
+		switch {
+		case len(item.Sku) == 0:
+			invalid.add(field+"Sku", "is required")
+		case utf8.RuneCountInString(item.Sku) > maxSku:
+			invalid.add(field+"Sku", fmt.Sprintf("must be at most %d characters", maxSku))
+		case !productChars.MatchString(item.Sku):
+			invalid.add(field+"Sku", "may only contain letters, digits, spaces and . _ -")
+		case len(o.Catalog) > 0 && !inCatalog(o.Catalog, item.Sku):
+			invalid.add(field+"Sku", "is not in the product catalog")
+		}
+
+		if item.Quantity < 1 || item.Quantity > maxQuantity {
+			invalid.add(field+"Quantity", fmt.Sprintf("must be between 1 and %d", maxQuantity))
+		}
+		if item.UnitPrice < 0 || item.UnitPrice > maxUnitPrice {
+			invalid.add(field+"UnitPrice", fmt.Sprintf("must be between 0 and %d", maxUnitPrice))
+		}
+
+		//One currency per order so the total means something
+		switch {
+		case !currencyCode.MatchString(item.Currency):
+			invalid.add(field+"Currency", "must be a three letter ISO 4217 code")
+		case item.Currency != order.Items[0].Currency:
+			invalid.add(field+"Currency", "must match the other items")
+		}
+	}
+
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// Trim what callers send and compute the item totals
+func normalize(order models.Order) models.Order {
+	order.CustomerName = strings.TrimSpace(order.CustomerName)
+	order.ProductName = strings.TrimSpace(order.ProductName)
+
+	items := make([]models.LineItem, len(order.Items))
+	for i, item := range order.Items {
+		items[i] = models.LineItem{
+			Sku:       strings.TrimSpace(item.Sku),
+			Quantity:  item.Quantity,
+			UnitPrice: item.UnitPrice,
+			Currency:  strings.ToUpper(strings.TrimSpace(item.Currency)),
+		}
+	}
+	order.SetItems(items)
+
+	return order
+}
+
+func (c *Customer) validate(customer models.Customer) error {
+	invalid := &ValidationError{subject: "customer"}
+
+	validateName(invalid, "Name", customer.Name)
+
+	switch {
+	case len(customer.Email) == 0:
+		invalid.add("Email", "is required")
+	case len(customer.Email) > maxEmail:
+		invalid.add("Email", fmt.Sprintf("must be at most %d characters", maxEmail))
+	case !emailAddress.MatchString(customer.Email):
+		invalid.add("Email", "must be an email address")
+	}
+
+	if len(customer.Phone) > 0 && !phoneNumber.MatchString(customer.Phone) {
+		invalid.add("Phone", "must be a phone number of digits, spaces and + ( ) . -")
+	}
+
+	if utf8.RuneCountInString(customer.ShippingAddress) > maxAddress {
+		invalid.add("ShippingAddress", fmt.Sprintf("must be at most %d characters", maxAddress))
+	}
+
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+func (w *Webhooks) validate(webhook models.Webhook) error {
+	invalid := &ValidationError{subject: "webhook"}
+
+	target, err := url.Parse(webhook.Url)
+	switch {
+	case len(webhook.Url) == 0:
+		invalid.add("Url", "is required")
+	case len(webhook.Url) > maxUrl:
+		invalid.add("Url", fmt.Sprintf("must be at most %d characters", maxUrl))
+	case err != nil || (target.Scheme != "https" && target.Scheme != "http") || len(target.Host) == 0:
+		invalid.add("Url", "must be an absolute http or https URL")
+	}
+
+	for i, event := range webhook.Events {
+		switch event {
+		case models.EventCreated, models.EventUpdated, models.EventDeleted, models.EventRestored:
+		default:
+			invalid.add(fmt.Sprintf("Events.%d", i), "must be created, updated, deleted or restored")
+		}
+	}
+
+	if len(invalid.Fields) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+func validateName(invalid *ValidationError, field string, name string) {
+	switch {
+	case len(name) == 0:
+		invalid.add(field, "is required")
+	case utf8.RuneCountInString(name) > maxCustomerName:
+		invalid.add(field, fmt.Sprintf("must be at most %d characters", maxCustomerName))
+	case !customerChars.MatchString(name):
+		invalid.add(field, "may only contain letters, spaces and . , ' -")
+	}
+}
+
+func inCatalog(catalog []string, product string) bool {
+	for _, p := range catalog {
+		if p == product {
+			return true
+		}
+	}
+	return false
+}
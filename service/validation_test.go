@@ -0,0 +1,174 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/lanceplarsen/go-vault-demo/models"
+)
+
+// Fields named in a validation error, nil when there is none
+func invalidFields(t *testing.T, err error) []string {
+	t.Helper()
+	if err == nil {
+		return nil
+	}
+	invalid, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("validate() = %T %v, want a *ValidationError", err, err)
+	}
+	var fields []string
+	for _, f := range invalid.Fields {
+		fields = append(fields, f.Field)
+	}
+	return fields
+}
+
+func TestValidateOrder(t *testing.T) {
+	item := models.LineItem{Sku: "vault-ent", Quantity: 1, UnitPrice: 500, Currency: "USD"}
+	var tooMany []models.LineItem
+	for i := 0; i <= maxItems; i++ {
+		tooMany = append(tooMany, item)
+	}
+
+	cases := []struct {
+		name    string
+		catalog []string
+		order   models.Order
+		want    []string
+	}{
+		{"valid", nil, models.Order{CustomerName: "Lance", ProductName: "Vault-Ent"}, nil},
+		{"unicode name", nil, models.Order{CustomerName: "Zoë O'Brien-Núñez", ProductName: "Vault"}, nil},
+		{"missing name", nil, models.Order{ProductName: "Vault"}, []string{"CustomerName"}},
+		{"blank name", nil, models.Order{CustomerName: "   ", ProductName: "Vault"}, []string{"CustomerName"}},
+		{"name with digits", nil, models.Order{CustomerName: "Lance 2", ProductName: "Vault"}, []string{"CustomerName"}},
+		{"name too long", nil, models.Order{CustomerName: strings.Repeat("é", maxCustomerName+1), ProductName: "Vault"}, []string{"CustomerName"}},
+		{"longest name", nil, models.Order{CustomerName: strings.Repeat("é", maxCustomerName), ProductName: "Vault"}, nil},
+		{"customer", nil, models.Order{CustomerId: 7, ProductName: "Vault"}, nil},
+		{"customer and name", nil, models.Order{CustomerId: 7, CustomerName: "Lance", ProductName: "Vault"}, []string{"CustomerName"}},
+		{"negative customer", nil, models.Order{CustomerId: -1, ProductName: "Vault"}, []string{"CustomerId"}},
+		{"missing product", nil, models.Order{CustomerName: "Lance"}, []string{"ProductName"}},
+		{"product too long", nil, models.Order{CustomerName: "Lance", ProductName: strings.Repeat("a", maxProductName+1)}, []string{"ProductName"}},
+		{"product punctuation", nil, models.Order{CustomerName: "Lance", ProductName: "Vault;drop"}, []string{"ProductName"}},
+		{"in catalog", []string{"Vault"}, models.Order{CustomerName: "Lance", ProductName: "Vault"}, nil},
+		{"not in catalog", []string{"Vault"}, models.Order{CustomerName: "Lance", ProductName: "Consul"}, []string{"ProductName"}},
+		{"every field", nil, models.Order{CustomerName: "1", ProductName: "?"}, []string{"CustomerName", "ProductName"}},
+		{"items", nil, models.Order{CustomerName: "Lance", Items: []models.LineItem{item, item}}, nil},
+		{"too many items", nil, models.Order{CustomerName: "Lance", Items: tooMany}, []string{"Items"}},
+		{"item fields", nil, models.Order{CustomerName: "Lance", Items: []models.LineItem{{Quantity: 0, UnitPrice: -1, Currency: "usd"}}},
+			[]string{"Items.0.Sku", "Items.0.Quantity", "Items.0.UnitPrice", "Items.0.Currency"}},
+		{"item limits", nil, models.Order{CustomerName: "Lance", Items: []models.LineItem{{Sku: "a", Quantity: maxQuantity + 1, UnitPrice: maxUnitPrice + 1, Currency: "USD"}}},
+			[]string{"Items.0.Quantity", "Items.0.UnitPrice"}},
+		{"mixed currencies", nil, models.Order{CustomerName: "Lance", Items: []models.LineItem{item, {Sku: "vault-ent", Quantity: 1, Currency: "EUR"}}},
+			[]string{"Items.1.Currency"}},
+		{"item not in catalog", []string{"Vault"}, models.Order{CustomerName: "Lance", Items: []models.LineItem{item}}, []string{"Items.0.Sku"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := &Order{Catalog: c.catalog}
+			got := invalidFields(t, o.validate(c.order))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("validate() fields = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	cases := []struct {
+		name    string
+		subject string
+		want    string
+	}{
+		{"order", "", "Invalid order: Name is required, Email must be an email address"},
+		{"customer", "customer", "Invalid customer: Name is required, Email must be an email address"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			invalid := &ValidationError{subject: c.subject}
+			invalid.add("Name", "is required")
+			invalid.add("Email", "must be an email address")
+			if got := invalid.Error(); got != c.want {
+				t.Errorf("Error() = %q, want %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateCustomer(t *testing.T) {
+	cases := []struct {
+		name     string
+		customer models.Customer
+		want     []string
+	}{
+		{"valid", models.Customer{Name: "Lance", Email: "lance@example.com", Phone: "+1 (555) 010-0000"}, nil},
+		{"no phone", models.Customer{Name: "Lance", Email: "lance@example.com"}, nil},
+		{"missing email", models.Customer{Name: "Lance"}, []string{"Email"}},
+		{"bad email", models.Customer{Name: "Lance", Email: "lance@example"}, []string{"Email"}},
+		{"email too long", models.Customer{Name: "Lance", Email: strings.Repeat("a", maxEmail) + "@example.com"}, []string{"Email"}},
+		{"bad phone", models.Customer{Name: "Lance", Email: "lance@example.com", Phone: "call me"}, []string{"Phone"}},
+		{"address too long", models.Customer{Name: "Lance", Email: "lance@example.com", ShippingAddress: strings.Repeat("a", maxAddress+1)}, []string{"ShippingAddress"}},
+		{"every field", models.Customer{Phone: "x", ShippingAddress: strings.Repeat("a", maxAddress+1)}, []string{"Name", "Email", "Phone", "ShippingAddress"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := invalidFields(t, (&Customer{}).validate(c.customer))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("validate() fields = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestValidateWebhook(t *testing.T) {
+	cases := []struct {
+		name    string
+		webhook models.Webhook
+		want    []string
+	}{
+		{"valid", models.Webhook{Url: "https://example.com/hook", Events: []string{models.EventCreated, models.EventRestored}}, nil},
+		{"every event", models.Webhook{Url: "http://example.com/hook"}, nil},
+		{"missing url", models.Webhook{}, []string{"Url"}},
+		{"relative url", models.Webhook{Url: "/hook"}, []string{"Url"}},
+		{"other scheme", models.Webhook{Url: "ftp://example.com/hook"}, []string{"Url"}},
+		{"unknown event", models.Webhook{Url: "https://example.com/hook", Events: []string{models.EventCreated, "paid"}}, []string{"Events.1"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := invalidFields(t, (&Webhooks{}).validate(c.webhook))
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("validate() fields = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	order := normalize(models.Order{
+		CustomerName: "  Lance ",
+		ProductName:  " Vault\t",
+		Items: []models.LineItem{
+			{Sku: " vault-ent ", Quantity: 2, UnitPrice: 500, Currency: " usd"},
+			{Sku: "consul", Quantity: 3, UnitPrice: 100, Currency: "USD"},
+		},
+	})
+
+	want := models.Order{
+		CustomerName: "Lance",
+		ProductName:  "Vault",
+		Items: []models.LineItem{
+			{Sku: "vault-ent", Quantity: 2, UnitPrice: 500, Currency: "USD", Total: 1000},
+			{Sku: "consul", Quantity: 3, UnitPrice: 100, Currency: "USD", Total: 300},
+		},
+		Total:    1300,
+		Currency: "USD",
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("normalize() = %+v, want %+v", order, want)
+	}
+}
@@ -0,0 +1,292 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lanceplarsen/go-vault-demo/client"
+	"github.com/lanceplarsen/go-vault-demo/dao"
+	"github.com/lanceplarsen/go-vault-demo/metrics"
+	"github.com/lanceplarsen/go-vault-demo/models"
+	"github.com/lanceplarsen/go-vault-demo/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+// Webhooks manages webhook subscriptions and sends what the orders trigger
+// queues in the outbox. Payloads are the order event with the masked view
+// of the order, signed with a transit HMAC.
+type Webhooks struct {
+	Vault  *client.Vault
+	Dao    *dao.Webhook
+	Events *Events
+	//Transit mount and key the payloads are signed with
+	Mount string
+	Key   string
+	//How often the outbox is checked for due deliveries
+	Poll time.Duration
+	//How long a receiver has to answer
+	Timeout     time.Duration
+	MaxAttempts int
+	//Wait after the first failure, doubled for each one after up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	client *http.Client
+}
+
+// Number of deliveries claimed and sent at a time
+const webhookBatch = 20
+
+// How much of a receiver's error response is kept with a failed delivery
+const maxWebhookError = 512
+
+func (w *Webhooks) GetWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	ctx, span := tracing.Start(ctx, "service.Webhooks.GetWebhooks")
+	defer span.End()
+
+	return w.Dao.FindAll(ctx)
+}
+
+func (w *Webhooks) CreateWebhook(ctx context.Context, webhook models.Webhook) (models.Webhook, error) {
+	ctx, span := tracing.Start(ctx, "service.Webhooks.CreateWebhook")
+	defer span.End()
+
+	if err := w.validate(webhook); err != nil {
+		return webhook, err
+	}
+	webhook.CreatedAt = time.Now().UTC()
+	return w.Dao.Insert(ctx, webhook)
+}
+
+// UpdateWebhook replaces the URL, events and active flag of a webhook.
+// Deliveries already queued are still sent.
+func (w *Webhooks) UpdateWebhook(ctx context.Context, webhook models.Webhook) (models.Webhook, error) {
+	ctx, span := tracing.Start(ctx, "service.Webhooks.UpdateWebhook")
+	defer span.End()
+
+	if err := w.validate(webhook); err != nil {
+		return webhook, err
+	}
+	if err := w.Dao.Update(ctx, webhook); err != nil {
+		return webhook, err
+	}
+	return w.Dao.FindById(ctx, webhook.Id)
+}
+
+func (w *Webhooks) DeleteWebhook(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "service.Webhooks.DeleteWebhook")
+	defer span.End()
+
+	return w.Dao.Delete(ctx, id)
+}
+
+func (w *Webhooks) GetDeadLetters(ctx context.Context) ([]models.DeadLetter, error) {
+	ctx, span := tracing.Start(ctx, "service.Webhooks.GetDeadLetters")
+	defer span.End()
+
+	return w.Dao.DeadLetters(ctx)
+}
+
+// RetryDeadLetter queues a dead letter for delivery again with a fresh set
+// of attempts
+func (w *Webhooks) RetryDeadLetter(ctx context.Context, id int64) error {
+	ctx, span := tracing.Start(ctx, "service.Webhooks.RetryDeadLetter")
+	defer span.End()
+
+	return w.Dao.Redrive(ctx, id, time.Now().UTC())
+}
+
+// Deliver sends due deliveries every poll until ctx is done
+func (w *Webhooks) Deliver(ctx context.Context) {
+	//Receivers don't get to send us somewhere else
+	w.client = &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	ticker := time.NewTicker(w.Poll)
+	defer ticker.Stop()
+
+	for {
+		//Keep going while there is a backlog
+		count, err := w.deliverBatch(ctx)
+		if err != nil {
+			log.WithError(err).Error("Webhook delivery failed")
+		}
+		if err == nil && count == webhookBatch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Claim a batch of due deliveries and send them side by side
+func (w *Webhooks) deliverBatch(ctx context.Context) (int, error) {
+	ctx, span := tracing.Start(ctx, "service.Webhooks.deliverBatch")
+	defer span.End()
+
+	//Every delivery in the batch is sent at once, so one timeout covers them
+	now := time.Now().UTC()
+	deliveries, err := w.Dao.Claim(ctx, now, now.Add(w.Timeout+time.Minute), webhookBatch)
+	if err != nil || len(deliveries) == 0 {
+		return 0, err
+	}
+
+	webhooks, err := w.Dao.FindAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+	urls := make(map[int64]string)
+	for _, webhook := range webhooks {
+		urls[webhook.Id] = webhook.Url
+	}
+
+	//Receivers get the order as it is now, masked like a caller without read-pii
+	var events []models.OrderEvent
+	for _, delivery := range deliveries {
+		events = append(events, models.OrderEvent{
+			Id:      delivery.EventId,
+			OrderId: delivery.OrderId,
+			Type:    delivery.Type,
+			Time:    delivery.Time,
+		})
+	}
+	events, err = w.Events.render(ctx, events, Masked)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for i := range deliveries {
+		url, ok := urls[deliveries[i].WebhookId]
+		if !ok {
+			//Deleted since we claimed it, and the outbox row went with it
+			continue
+		}
+		wg.Add(1)
+		go func(delivery models.WebhookDelivery, event models.OrderEvent) {
+			defer wg.Done()
+			w.attempt(ctx, url, delivery, event)
+		}(deliveries[i], events[i])
+	}
+	wg.Wait()
+
+	return len(deliveries), nil
+}
+
+// Send one delivery and record the outcome
+func (w *Webhooks) attempt(ctx context.Context, url string, delivery models.WebhookDelivery, event models.OrderEvent) {
+	logger := log.WithFields(log.Fields{
+		"delivery_id": delivery.Id,
+		"webhook_id":  delivery.WebhookId,
+		"event_id":    delivery.EventId,
+	})
+
+	err := w.send(ctx, url, delivery, event)
+	if err == nil {
+		metrics.WebhookDelivery("delivered")
+		if err := w.Dao.Delivered(ctx, delivery.Id); err != nil {
+			logger.WithError(err).Error("Unable to clear delivered webhook")
+		}
+		return
+	}
+
+	now := time.Now().UTC()
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if len(delivery.LastError) > maxWebhookError {
+		delivery.LastError = delivery.LastError[:maxWebhookError]
+	}
+
+	if delivery.Attempts >= w.MaxAttempts {
+		metrics.WebhookDelivery("dead-letter")
+		logger.WithError(err).WithField("attempts", delivery.Attempts).Warn("Webhook delivery dead-lettered")
+		if err := w.Dao.DeadLetter(ctx, delivery, now); err != nil {
+			logger.WithError(err).Error("Unable to dead-letter webhook delivery")
+		}
+		return
+	}
+
+	metrics.WebhookDelivery("retry")
+	delivery.NextAttemptAt = now.Add(w.backoff(delivery.Attempts))
+	logger.WithError(err).WithFields(log.Fields{
+		"attempts":   delivery.Attempts,
+		"next_retry": delivery.NextAttemptAt,
+	}).Info("Webhook delivery failed")
+	if err := w.Dao.Retry(ctx, delivery); err != nil {
+		logger.WithError(err).Error("Unable to reschedule webhook delivery")
+	}
+}
+
+// POST the signed event. Anything but a 2xx is a failure.
+func (w *Webhooks) send(ctx context.Context, url string, delivery models.WebhookDelivery, event models.OrderEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	//Sign the timestamp with the body so a captured request can't be replayed later
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature, err := w.sign(ctx, timestamp, body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Delivery", strconv.FormatInt(delivery.Id, 10))
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signature)
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, maxWebhookError))
+		return fmt.Errorf("Receiver answered %d: %s", resp.StatusCode, bytes.TrimSpace(reason))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxWebhookError))
+	return nil
+}
+
+// HMAC of the timestamp and body, which receivers check with transit verify
+func (w *Webhooks) sign(ctx context.Context, timestamp string, body []byte) (string, error) {
+	input := base64.StdEncoding.EncodeToString(append([]byte(timestamp+"."), body...))
+	return w.Vault.HMAC(ctx, fmt.Sprintf("%s/hmac/%s", w.Mount, w.Key), input)
+}
+
+// Exponential with jitter so failing receivers aren't hit in lockstep
+func (w *Webhooks) backoff(attempts int) time.Duration {
+	wait := w.Backoff
+	for i := 1; i < attempts && wait < w.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > w.MaxBackoff {
+		wait = w.MaxBackoff
+	}
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	w := &Webhooks{Backoff: 30 * time.Second, MaxBackoff: time.Hour}
+
+	cases := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprint(c.attempts), func(t *testing.T) {
+			//Jitter keeps each wait in the upper half of the step
+			for i := 0; i < 100; i++ {
+				if got := w.backoff(c.attempts); got < c.max/2 || got > c.max {
+					t.Fatalf("backoff(%d) = %v, want between %v and %v", c.attempts, got, c.max/2, c.max)
+				}
+			}
+		})
+	}
+}